@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// annotationLabel is the label --annotate sets on the configs and secrets, its value is the generated KEY=VALUE
+const annotationLabel = "dev.megpoid.docker-deploy.hash"
+
+// composeAnnotations collects the variable generated for each config and secret of the compose files
+type composeAnnotations struct {
+	mu sync.Mutex
+	// entries maps each compose file to the kind and name of its entries, like config/app, and their KEY=VALUE
+	entries map[string]map[string]string
+}
+
+func newComposeAnnotations() *composeAnnotations {
+	return &composeAnnotations{entries: make(map[string]map[string]string)}
+}
+
+func (a *composeAnnotations) add(filename, kind, name, env string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.entries[filename] == nil {
+		a.entries[filename] = make(map[string]string)
+	}
+	a.entries[filename][kind+"/"+name] = env
+}
+
+// write annotates every compose file that generated a variable
+func (a *composeAnnotations) write() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	filenames := make([]string, 0, len(a.entries))
+	for filename := range a.entries {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		if filename == "-" {
+			logger.Warnf("Cannot annotate the compose file read from stdin")
+			continue
+		}
+
+		if err := annotateComposeFile(filename, a.entries[filename]); err != nil {
+			return fmt.Errorf("cannot annotate compose file %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// annotateComposeFile sets the annotation label of the configs and secrets of the file, going through the yaml nodes
+// so the comments and the order of the keys are kept. The previous version is kept with a .orig suffix, the file is
+// only written when any label changed.
+func annotateComposeFile(filename string, entries map[string]string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var docs []*yaml.Node
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		docs = append(docs, &doc)
+	}
+
+	changed := false
+	for _, doc := range docs {
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		for _, kind := range []string{"config", "secret"} {
+			section := mappingValue(doc.Content[0], kind+"s")
+			if section == nil || section.Kind != yaml.MappingNode {
+				continue
+			}
+
+			for i := 0; i+1 < len(section.Content); i += 2 {
+				env, ok := entries[kind+"/"+section.Content[i].Value]
+				if !ok {
+					continue
+				}
+
+				if setLabel(section.Content[i+1], annotationLabel, env) {
+					changed = true
+				}
+			}
+		}
+	}
+
+	if !changed {
+		logger.With(logFields{"file": filename}).Debugf("Compose file %s is already annotated", filename)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filename+".orig", data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot back up the original file: %w", err)
+	}
+
+	if err := writeFileAtomic(filename, buf.Bytes(), info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	logger.With(logFields{"file": filename}).Infof("Annotated compose file %s, the previous version is kept in %s.orig", filename, filename)
+
+	return nil
+}
+
+// mappingValue returns the value of the key of a mapping node, nil when missing
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// setLabel sets the label of a config or secret definition, whose labels can be a mapping or a list of key=value
+// strings. It reports whether the definition changed.
+func setLabel(entry *yaml.Node, key, value string) bool {
+	if entry.Kind != yaml.MappingNode {
+		return false
+	}
+
+	labels := mappingValue(entry, "labels")
+	if labels == nil {
+		labels = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		entry.Content = append(entry.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "labels"},
+			labels,
+		)
+	}
+
+	switch labels.Kind {
+	case yaml.MappingNode:
+		if current := mappingValue(labels, key); current != nil {
+			if current.Value == value {
+				return false
+			}
+			current.Kind, current.Tag, current.Value = yaml.ScalarNode, "!!str", value
+			return true
+		}
+
+		labels.Content = append(labels.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+		)
+		return true
+	case yaml.SequenceNode:
+		item := key + "=" + value
+		for _, label := range labels.Content {
+			if label.Value == item {
+				return false
+			}
+			if strings.HasPrefix(label.Value, key+"=") {
+				label.Value = item
+				return true
+			}
+		}
+
+		labels.Content = append(labels.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxFileSize is far above what swarm accepts for a config or secret, it only stops the pathological files
+const defaultMaxFileSize = "256M"
+
+// byteSizeUnits are the suffixes of parseByteSize, in powers of 1024
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseByteSize parses a number of bytes with an optional K, M, G or T suffix, which can be followed by B or iB
+func parseByteSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	if strings.HasSuffix(number, "IB") {
+		number = strings.TrimSuffix(number, "IB")
+	} else {
+		number = strings.TrimSuffix(number, "B")
+	}
+
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSuffix(number, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, use a number of bytes with an optional K, M, G or T suffix", value)
+	}
+
+	if size > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q, too large", value)
+	}
+
+	return size * multiplier, nil
+}
+
+// formatByteSize returns the size with the largest unit that keeps it readable
+func formatByteSize(size int64) string {
+	for _, unit := range byteSizeUnits {
+		if size >= unit.size {
+			return strconv.FormatFloat(float64(size)/float64(unit.size), 'f', 1, 64) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(size, 10) + "B"
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// completionShells lists the shells supported by the completion subcommand
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionFileFlags are the flags completed with file names
+var completionFileFlags = map[string]bool{
+	"ca-cert":      true,
+	"compose-file": true,
+	"config":       true,
+	"env-file":     true,
+	"hash-cache":   true,
+	"lockfile":     true,
+	"log-file":     true,
+	"manifest":     true,
+	"metrics-file": true,
+	"state-file":   true,
+	"summary-file": true,
+	"trace-file":   true,
+}
+
+// completionDirFlags are the flags completed with directory names
+var completionDirFlags = map[string]bool{
+	"working-dir": true,
+}
+
+// completionValues returns the fixed values accepted by a flag, or nil when it takes any value
+func completionValues(name string) []string {
+	switch name {
+	case "mode":
+		return []string{modeStack, modeCompose}
+	case "hash-algo":
+		algos := make([]string, 0, len(hashAlgorithms))
+		for algo := range hashAlgorithms {
+			algos = append(algos, algo)
+		}
+		sort.Strings(algos)
+		return algos
+	case "resolve-image":
+		return []string{"always", "changed", "never"}
+	case "hash-source":
+		return []string{hashSourceContent, hashSourceGitBlob}
+	case "orchestrator":
+		return []string{"swarm", "kubernetes"}
+	case "color":
+		return []string{"auto", "always", "never"}
+	case "env-output":
+		return []string{envOutputDotenv, envOutputYAML, envOutputJSON}
+	case "log-format", "version":
+		return []string{"text", "json"}
+	case "on-missing-file":
+		return []string{missingFileSkip, missingFileWarn, missingFileFail}
+	default:
+		return nil
+	}
+}
+
+// completionFlag is a flag as seen by the completion scripts
+type completionFlag struct {
+	Name      string
+	Shorthand string
+	Usage     string
+	// TakesValue is false for the boolean and counter flags
+	TakesValue bool
+	// OptionalValue is true when the value can be omitted, like --version
+	OptionalValue bool
+	Repeatable    bool
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Hidden {
+			return
+		}
+
+		kind := f.Value.Type()
+		flags = append(flags, completionFlag{
+			Name:          f.Name,
+			Shorthand:     f.Shorthand,
+			Usage:         f.Usage,
+			TakesValue:    kind != "bool" && kind != "count",
+			OptionalValue: f.NoOptDefVal != "" && kind != "bool" && kind != "count",
+			Repeatable:    strings.HasSuffix(kind, "Slice") || strings.HasSuffix(kind, "Array") || kind == "count",
+		})
+	})
+
+	return flags
+}
+
+// writeCompletion writes the completion script of the flags for the given shell
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	flags := completionFlags(fs)
+
+	var script string
+	switch shell {
+	case "bash":
+		script = bashCompletion(flags)
+	case "zsh":
+		script = zshCompletion(flags)
+	case "fish":
+		script = fishCompletion(flags)
+	default:
+		return fmt.Errorf("invalid shell %q, valid values are: %s", shell, strings.Join(completionShells, ", "))
+	}
+
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+func bashCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	var words, files, dirs, others []string
+
+	sb.WriteString("# bash completion for docker-deploy, load it with: source <(docker-deploy completion bash)\n")
+	sb.WriteString("_docker_deploy() {\n")
+	sb.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n\n")
+	sb.WriteString("\tcase \"$prev\" in\n")
+
+	for _, f := range flags {
+		names := []string{"--" + f.Name}
+		if f.Shorthand != "" {
+			names = append(names, "-"+f.Shorthand)
+		}
+		words = append(words, names...)
+
+		// the optional values can only be given as --flag=value, so the next word isn't completed as a value
+		if !f.TakesValue || f.OptionalValue {
+			continue
+		}
+
+		switch {
+		case completionValues(f.Name) != nil:
+			fmt.Fprintf(&sb, "\t%s)\n", strings.Join(names, "|"))
+			fmt.Fprintf(&sb, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(completionValues(f.Name), " "))
+			sb.WriteString("\t\treturn\n\t\t;;\n")
+		case completionFileFlags[f.Name]:
+			files = append(files, names...)
+		case completionDirFlags[f.Name]:
+			dirs = append(dirs, names...)
+		default:
+			others = append(others, names...)
+		}
+	}
+
+	if len(files) > 0 {
+		fmt.Fprintf(&sb, "\t%s)\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\treturn\n\t\t;;\n", strings.Join(files, "|"))
+	}
+	if len(dirs) > 0 {
+		fmt.Fprintf(&sb, "\t%s)\n\t\tCOMPREPLY=($(compgen -d -- \"$cur\"))\n\t\treturn\n\t\t;;\n", strings.Join(dirs, "|"))
+	}
+	if len(others) > 0 {
+		fmt.Fprintf(&sb, "\t%s)\n\t\treturn\n\t\t;;\n", strings.Join(others, "|"))
+	}
+
+	sb.WriteString("\tesac\n\n")
+	sb.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(&sb, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(words, " "))
+	sb.WriteString("\telif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	sb.WriteString("\t\tCOMPREPLY=($(compgen -W \"env\" -- \"$cur\"))\n")
+	sb.WriteString("\tfi\n")
+	sb.WriteString("}\n\n")
+	sb.WriteString("complete -o default -F _docker_deploy docker-deploy\n")
+
+	return sb.String()
+}
+
+// zshEscape escapes the characters with a meaning in the _arguments specs
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:").Replace(s)
+}
+
+func zshCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+
+	sb.WriteString("#compdef docker-deploy\n")
+	sb.WriteString("# zsh completion for docker-deploy, load it with: source <(docker-deploy completion zsh)\n\n")
+	sb.WriteString("_docker_deploy() {\n")
+	sb.WriteString("\t_arguments -s \\\n")
+
+	for _, f := range flags {
+		action := ""
+		if f.TakesValue {
+			switch {
+			case completionValues(f.Name) != nil:
+				action = fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(completionValues(f.Name), " "))
+			case completionFileFlags[f.Name]:
+				action = ":file:_files"
+			case completionDirFlags[f.Name]:
+				action = ":directory:_files -/"
+			default:
+				action = ":" + f.Name + ": "
+			}
+		}
+
+		repeat := ""
+		if f.Repeatable {
+			repeat = "*"
+		}
+
+		long := "--" + f.Name
+		switch {
+		case f.OptionalValue:
+			long += "=-"
+		case f.TakesValue:
+			long += "="
+		}
+
+		if f.Shorthand != "" && !f.OptionalValue {
+			exclude := fmt.Sprintf("(-%s --%s)", f.Shorthand, f.Name)
+			if f.Repeatable {
+				exclude = ""
+			}
+			sb.WriteString("\t\t")
+			if exclude+repeat != "" {
+				fmt.Fprintf(&sb, "'%s%s'", exclude, repeat)
+			}
+			fmt.Fprintf(&sb, "{-%s,%s}'[%s]%s' \\\n", f.Shorthand, long, zshEscape(f.Usage), action)
+			continue
+		}
+
+		fmt.Fprintf(&sb, "\t\t'%s%s[%s]%s' \\\n", repeat, long, zshEscape(f.Usage), action)
+	}
+
+	sb.WriteString("\t\t'1:command or stack name:(env)' \\\n")
+	sb.WriteString("\t\t'*::docker argument: '\n")
+	sb.WriteString("}\n\n")
+	sb.WriteString("compdef _docker_deploy docker-deploy\n")
+
+	return sb.String()
+}
+
+// fishQuote quotes a string for fish, where only the quotes and backslashes are special inside single quotes
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s) + "'"
+}
+
+func fishCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+
+	sb.WriteString("# fish completion for docker-deploy, load it with: docker-deploy completion fish | source\n")
+	sb.WriteString("complete -c docker-deploy -n __fish_use_subcommand -f -a env -d 'Print the generated variables'\n")
+
+	for _, f := range flags {
+		fmt.Fprintf(&sb, "complete -c docker-deploy -l %s", f.Name)
+		if f.Shorthand != "" {
+			fmt.Fprintf(&sb, " -s %s", f.Shorthand)
+		}
+
+		if f.TakesValue && !f.OptionalValue {
+			switch {
+			case completionValues(f.Name) != nil:
+				fmt.Fprintf(&sb, " -x -a %s", fishQuote(strings.Join(completionValues(f.Name), " ")))
+			case completionFileFlags[f.Name]:
+				sb.WriteString(" -r -F")
+			case completionDirFlags[f.Name]:
+				sb.WriteString(" -x -a '(__fish_complete_directories)'")
+			default:
+				sb.WriteString(" -x")
+			}
+		}
+
+		fmt.Fprintf(&sb, " -d %s\n", fishQuote(f.Usage))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// confirmDeploy asks whether to deploy the stack to a production daemon, reading the answer from stdin. Without a
+// terminal to ask on it refuses, --yes has to be given instead.
+func (d *deployer) confirmDeploy(stack stackDeploy) error {
+	daemon := d.daemonName(stack)
+
+	if !isTerminal(d.stdin) {
+		return fmt.Errorf("refusing to deploy stack %s to %s, a production daemon, without a confirmation: stdin is not a terminal, use --yes", stack.Name, daemon)
+	}
+
+	_, _ = fmt.Fprintf(d.stderr, "Deploy %s to %s? [y/N] ", stack.Name, daemon)
+
+	answer, err := bufio.NewReader(d.stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("cannot read the confirmation: %w", err)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return fmt.Errorf("deploy of stack %s to %s cancelled", stack.Name, daemon)
+	}
+}
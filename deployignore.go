@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// deployIgnoreFile is read from the root of a hashed directory, its gitignore style patterns exclude paths from the
+// hash. The file itself is never hashed.
+const deployIgnoreFile = ".deployignore"
+
+// ignoreRule is a pattern of the ignore file converted to a regexp matching the slash separated relative paths
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreRules []ignoreRule
+
+// loadIgnoreRules reads the ignore file of the directory, a missing file doesn't ignore anything
+func loadIgnoreRules(dir string) (ignoreRules, error) {
+	filename := filepath.Join(dir, deployIgnoreFile)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	rules, err := parseIgnoreRules(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", filename, err)
+	}
+
+	return rules, nil
+}
+
+// parseIgnoreRules converts the lines of an ignore file with the gitignore syntax: patterns with a slash other than a
+// trailing one are anchored to the directory root, the others match at any depth. A trailing slash only matches
+// directories, * and ? don't match a slash, ** matches any number of directories and ! re-includes a path.
+func parseIgnoreRules(data string) (ignoreRules, error) {
+	var rules ignoreRules
+
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		expr := ignorePatternExpr(line)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+
+		pattern, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q", n+1, line)
+		}
+		rule.pattern = pattern
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ignorePatternExpr converts the wildcards of a pattern to a regular expression
+func ignorePatternExpr(pattern string) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		atStart := i == 0 || pattern[i-1] == '/'
+
+		switch c := pattern[i]; {
+		case atStart && strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case atStart && pattern[i:] == "**":
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	return sb.String()
+}
+
+// ignored reports whether the slash separated path relative to the directory root is excluded, the last matching
+// rule wins
+func (r ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.pattern.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// dockerConfigEnvVar overrides the directory of the docker CLI config, like for docker itself
+const dockerConfigEnvVar = "DOCKER_CONFIG"
+
+// dockerCLIConfig holds the settings of the docker CLI config.json used by docker-deploy
+type dockerCLIConfig struct {
+	CurrentContext string `json:"currentContext"`
+}
+
+// dockerConfigDir returns the directory of the docker CLI config, DOCKER_CONFIG or ~/.docker
+func dockerConfigDir() (string, error) {
+	if dir := os.Getenv(dockerConfigEnvVar); dir != "" {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".docker"), nil
+}
+
+// currentDockerContext returns the current context of the docker CLI config. It is empty when the file doesn't
+// exist or selects the default context, which is the local daemon.
+func currentDockerContext() (string, error) {
+	dir, err := dockerConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find the docker config directory: %w", err)
+	}
+
+	filename := filepath.Join(dir, "config.json")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Debugf("No docker config file %s found", filename)
+			return "", nil
+		}
+		return "", err
+	}
+
+	var cfg dockerCLIConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("cannot parse docker config file %s: %w", filename, err)
+	}
+
+	if cfg.CurrentContext == "default" {
+		return "", nil
+	}
+
+	logger.With(logFields{"file": filename}).Debugf("Using the current context %s of %s", cfg.CurrentContext, filename)
+
+	return cfg.CurrentContext, nil
+}
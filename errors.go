@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// exitCoder is implemented by the errors that tell the exit code of docker-deploy
+type exitCoder interface {
+	ExitCode() int
+}
+
+// exitCodeOf returns the exit code of the first error in the chain of err that has one, or code when none has
+func exitCodeOf(err error, code int) int {
+	var coder exitCoder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+
+	return code
+}
+
+// ConfigNotFoundError is returned when a config file given explicitly isn't found in any of the searched directories
+type ConfigNotFoundError struct {
+	Names []string
+	Dirs  []string
+}
+
+func (e *ConfigNotFoundError) Error() string {
+	return fmt.Sprintf("config file %s not found in the current directory or any of its parents", strings.Join(e.Names, ", "))
+}
+
+func (e *ConfigNotFoundError) ExitCode() int {
+	return exitConfig
+}
+
+// ConfigParseError is returned when a config file cannot be decoded in the format given by its extension
+type ConfigParseError struct {
+	File string
+	Err  error
+}
+
+func (e *ConfigParseError) Error() string {
+	return fmt.Sprintf("cannot parse config file %s: %s", e.File, e.Err)
+}
+
+func (e *ConfigParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConfigParseError) ExitCode() int {
+	return exitConfig
+}
+
+// ComposeParseError is returned when a compose file isn't valid yaml or doesn't look like a compose file
+type ComposeParseError struct {
+	File string
+	Err  error
+}
+
+func (e *ComposeParseError) Error() string {
+	return fmt.Sprintf("cannot parse compose file %s: %s", e.File, e.Err)
+}
+
+func (e *ComposeParseError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ComposeParseError) ExitCode() int {
+	return exitCompose
+}
+
+// DockerExecError is returned when the docker command ran but exited with a non zero code, which is also the exit
+// code of docker-deploy
+type DockerExecError struct {
+	Daemon string
+	Code   int
+}
+
+func (e *DockerExecError) Error() string {
+	return fmt.Sprintf("the docker command failed on %s with exit code %d", e.Daemon, e.Code)
+}
+
+func (e *DockerExecError) ExitCode() int {
+	return e.Code
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCodeOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"config not found", &ConfigNotFoundError{Names: []string{".docker-deploy.yml"}}, exitConfig},
+		{"config parse", &ConfigParseError{File: ".docker-deploy.yml", Err: errors.New("bad")}, exitConfig},
+		{"compose parse", &ComposeParseError{File: "docker-compose.yml", Err: errors.New("bad")}, exitCompose},
+		{"wrapped compose parse", fmt.Errorf("local compose files: %w", &ComposeParseError{File: "docker-compose.yml"}), exitCompose},
+		{"docker exec", &DockerExecError{Daemon: "tcp://a", Code: 42}, 42},
+		{"untyped", errors.New("plain"), exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCodeOf(tt.err, exitError); got != tt.want {
+				t.Errorf("exitCodeOf() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
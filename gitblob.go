@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"os/exec"
+	"path/filepath"
+)
+
+// sources of the version of the config and secret files
+const (
+	hashSourceContent = "content"
+	hashSourceGitBlob = "git-blob"
+)
+
+// gitBlobHash returns a hash computing the git blob object id of a file of the given size, the sha1 of a
+// "blob <size>" header and the content, like git hash-object does without filters
+func gitBlobHash(size int64) hash.Hash {
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "blob %d\x00", size)
+	return h
+}
+
+// gitTracked reports whether the file is tracked by the git repository it is in. A missing git binary or a file
+// outside of a repository are reported as untracked.
+func gitTracked(filePath string) bool {
+	cmd := exec.Command("git", "ls-files", "--error-unmatch", "--", filepath.Base(filePath))
+	cmd.Dir = filepath.Dir(filePath)
+
+	return cmd.Run() == nil
+}
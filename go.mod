@@ -3,11 +3,15 @@ module megpoid.dev/go/docker-deploy
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
 	github.com/kr/pretty v0.1.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// hashCacheEntry is the digest of a file at the time it had the given size and modification time
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Digest  string `json:"digest"`
+}
+
+// hashCache stores the full digests of the hashed files so unchanged files don't have to be read again
+type hashCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]hashCacheEntry
+	dirty   bool
+}
+
+// loadHashCache reads the cache file, a missing or unreadable cache starts empty
+func loadHashCache(path string) *hashCache {
+	cache := &hashCache{path: path, entries: make(map[string]hashCacheEntry)}
+
+	entries, err := readHashCacheFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("Ignoring hash cache %s: %s", path, err.Error())
+		}
+		return cache
+	}
+
+	cache.entries = entries
+
+	return cache
+}
+
+func readHashCacheFile(path string) (map[string]hashCacheEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]hashCacheEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func hashCacheKey(filePath, algo string) string {
+	if absPath, err := filepath.Abs(filePath); err == nil {
+		filePath = absPath
+	}
+
+	return algo + ":" + filePath
+}
+
+// lookup returns the cached digest of the file if its size and modification time didn't change
+func (c *hashCache) lookup(filePath, algo string, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[hashCacheKey(filePath, algo)]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return nil, false
+	}
+
+	digest, err := hex.DecodeString(entry.Digest)
+	if err != nil {
+		return nil, false
+	}
+
+	return digest, true
+}
+
+func (c *hashCache) store(filePath, algo string, info os.FileInfo, digest []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[hashCacheKey(filePath, algo)] = hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Digest:  hex.EncodeToString(digest),
+	}
+	c.dirty = true
+}
+
+// save writes the cache if it changed. The entries written meanwhile by other runs are kept, and the file is replaced
+// with a rename so concurrent runs never see a partially written cache.
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	entries, err := readHashCacheFile(c.path)
+	if err != nil {
+		entries = make(map[string]hashCacheEntry)
+	}
+
+	for k, v := range c.entries {
+		entries[k] = v
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.path, data, 0600); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// hashMemo holds the digests computed by a run, unlike the cache it doesn't check whether the files changed
+type hashMemo struct {
+	mu      sync.Mutex
+	digests map[string][]byte
+}
+
+func newHashMemo() *hashMemo {
+	return &hashMemo{digests: make(map[string][]byte)}
+}
+
+func (m *hashMemo) lookup(filePath, algo string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	digest, ok := m.digests[hashCacheKey(filePath, algo)]
+	return digest, ok
+}
+
+func (m *hashMemo) store(filePath, algo string, digest []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.digests[hashCacheKey(filePath, algo)] = digest
+}
+
+// memoFile is a file to hash with the options of the entry referencing it
+type memoFile struct {
+	path string
+	opts hashOptions
+}
+
+// hashFiles hashes each of the files once, up to concurrency at the same time, and returns their full digests in the
+// same order, the entries sharing a file get the same digest. The files already in the memo are not read again, and
+// the ones that cannot be hashed get a nil digest, the error is reported when the entry hashes them again.
+func (m *hashMemo) hashFiles(files []memoFile, concurrency int) [][]byte {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	seen := make(map[string]bool, len(files))
+
+	for _, file := range files {
+		key := hashCacheKey(file.path, file.opts.cacheAlgo())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if _, ok := m.lookup(file.path, file.opts.cacheAlgo()); ok {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(file memoFile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			file.opts.Memo = m
+			_, _ = fileHash(file.path, file.opts)
+		}(file)
+	}
+
+	wg.Wait()
+
+	digests := make([][]byte, len(files))
+	for i, file := range files {
+		digests[i], _ = m.lookup(file.path, file.opts.cacheAlgo())
+	}
+
+	return digests
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and renames it over the target, which
+// gets the given permissions
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	// the temporary file is always created 0600
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
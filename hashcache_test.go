@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFilesSharedDigests(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared.conf")
+	other := filepath.Join(dir, "other.conf")
+	if err := ioutil.WriteFile(shared, []byte("shared"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(other, []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := hashOptions{Algo: "sha256", Length: 8}
+	files := []memoFile{
+		{path: shared, opts: opts},
+		{path: other, opts: opts},
+		{path: shared, opts: opts},
+		{path: filepath.Join(dir, "missing.conf"), opts: opts},
+	}
+
+	digests := newHashMemo().hashFiles(files, 2)
+	if len(digests) != len(files) {
+		t.Fatalf("got %d digests, want %d", len(digests), len(files))
+	}
+	if len(digests[0]) != 32 {
+		t.Errorf("got a %d bytes digest, want the full 32 bytes", len(digests[0]))
+	}
+	if !bytes.Equal(digests[0], digests[2]) {
+		t.Errorf("the entries sharing %s got different digests", shared)
+	}
+	if bytes.Equal(digests[0], digests[1]) {
+		t.Errorf("different files got the same digest")
+	}
+	if digests[3] != nil {
+		t.Errorf("got a digest for a missing file")
+	}
+}
+
+// BenchmarkHashFiles compares hashing the files referenced by several entries with and without the memo
+func BenchmarkHashFiles(b *testing.B) {
+	dir := b.TempDir()
+	content := bytes.Repeat([]byte("key = value\n"), 16*1024)
+
+	const distinct, refs = 4, 8
+	opts := hashOptions{Algo: "sha256", Length: 8}
+	var files []memoFile
+	for i := 0; i < distinct; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("shared%d.conf", i))
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < refs; j++ {
+			files = append(files, memoFile{path: path, opts: opts})
+		}
+	}
+
+	b.Run("memoized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newHashMemo().hashFiles(files, 4)
+		}
+	})
+
+	b.Run("unmemoized", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, file := range files {
+				if _, err := fileHash(file.path, file.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
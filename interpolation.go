@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lookupFunc returns the value of a variable and whether it is set, like os.LookupEnv
+type lookupFunc func(name string) (string, bool)
+
+// newEnvLookup returns a lookup that prefers the values read from the env files over the process environment
+func newEnvLookup(fileEnv []string, environ []string) lookupFunc {
+	values := make(map[string]string, len(fileEnv)+len(environ))
+
+	for _, entries := range [][]string{environ, fileEnv} {
+		for _, entry := range entries {
+			key, value, _ := strings.Cut(entry, "=")
+			values[key] = value
+		}
+	}
+
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+// interpolate expands the variables of s following the compose file rules: $$ is a literal $, $VAR and ${VAR} are
+// replaced by the value of VAR, and ${VAR:-default}, ${VAR-default}, ${VAR:?error}, ${VAR?error}, ${VAR:+replacement}
+// and ${VAR+replacement} behave like in a POSIX shell. Unset variables expand to an empty string with a warning,
+// or are an error when strict is set.
+func interpolate(s string, lookup lookupFunc, strict bool) (string, error) {
+	var sb strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		switch next := s[i+1]; {
+		case next == '$':
+			sb.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format in %q: missing closing brace", s)
+			}
+
+			value, err := expandBraced(s[i+2:end], lookup, strict)
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString(value)
+			i = end
+		case isNameStart(next):
+			end := i + 1
+			for end < len(s) && isNameChar(s[end]) {
+				end++
+			}
+
+			value, err := lookupVariable(s[i+1:end], lookup, strict)
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString(value)
+			i = end - 1
+		default:
+			sb.WriteByte('$')
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// closingBrace returns the index of the brace closing the expression starting at start, allowing nested expressions
+// in default values, or -1 if there is none
+func closingBrace(s string, start int) int {
+	depth := 1
+
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// expandBraced expands the content of a ${...} expression
+func expandBraced(expr string, lookup lookupFunc, strict bool) (string, error) {
+	end := 0
+	for end < len(expr) && isNameChar(expr[end]) {
+		end++
+	}
+
+	name, rest := expr[:end], expr[end:]
+	if name == "" || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}: invalid variable name", expr)
+	}
+
+	if rest == "" {
+		return lookupVariable(name, lookup, strict)
+	}
+
+	value, set := lookup(name)
+
+	// with a colon the modifiers treat an empty variable as unset
+	emptyIsUnset := strings.HasPrefix(rest, ":")
+	if emptyIsUnset {
+		rest = rest[1:]
+		set = set && value != ""
+	}
+
+	if rest == "" {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+	}
+
+	arg, err := interpolate(rest[1:], lookup, strict)
+	if err != nil {
+		return "", err
+	}
+
+	switch rest[0] {
+	case '-':
+		if !set {
+			return arg, nil
+		}
+		return value, nil
+	case '?':
+		if !set {
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, arg)
+		}
+		return value, nil
+	case '+':
+		if set {
+			return arg, nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+	}
+}
+
+func lookupVariable(name string, lookup lookupFunc, strict bool) (string, error) {
+	value, ok := lookup(name)
+	if ok {
+		return value, nil
+	}
+
+	if strict {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+
+	logger.Warnf("The %s variable is not set, defaulting to a blank string", name)
+
+	return "", nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	lookup := newEnvLookup([]string{"CONF=file.conf"}, []string{"DIR=config", "EMPTY=", "CONF=env.conf"})
+
+	tests := []struct {
+		name    string
+		in      string
+		strict  bool
+		want    string
+		wantErr bool
+	}{
+		{name: "no variable", in: "./app.conf", want: "./app.conf"},
+		{name: "plain", in: "./$DIR/app.conf", want: "./config/app.conf"},
+		{name: "braced", in: "./${DIR}s/app.conf", want: "./configs/app.conf"},
+		{name: "env file wins", in: "./$CONF", want: "./file.conf"},
+		{name: "escaped dollar", in: "./$$DIR", want: "./$DIR"},
+		{name: "trailing dollar", in: "./app$", want: "./app$"},
+		{name: "dollar before a digit", in: "./$1", want: "./$1"},
+		{name: "unset", in: "./$UNSET/app.conf", want: ".//app.conf"},
+		{name: "unset braced", in: "./${UNSET}app.conf", want: "./app.conf"},
+		{name: "default when unset", in: "${UNSET-dev}.conf", want: "dev.conf"},
+		{name: "default keeps empty", in: "${EMPTY-dev}.conf", want: ".conf"},
+		{name: "colon default when empty", in: "${EMPTY:-dev}.conf", want: "dev.conf"},
+		{name: "default not used when set", in: "${DIR:-dev}", want: "config"},
+		{name: "nested default", in: "${UNSET:-${DIR}/app}.conf", want: "config/app.conf"},
+		{name: "replacement when set", in: "app${DIR:+.local}.conf", want: "app.local.conf"},
+		{name: "no replacement when empty", in: "app${EMPTY:+.local}.conf", want: "app.conf"},
+		{name: "replacement when set empty", in: "app${EMPTY+.local}.conf", want: "app.local.conf"},
+		{name: "required and set", in: "${DIR:?the dir is needed}", want: "config"},
+		{name: "required and unset", in: "${UNSET?the dir is needed}", wantErr: true},
+		{name: "required and empty", in: "${EMPTY:?the dir is needed}", wantErr: true},
+		{name: "missing closing brace", in: "${DIR", wantErr: true},
+		{name: "invalid name", in: "${1DIR}", wantErr: true},
+		{name: "empty expression", in: "${}", wantErr: true},
+		{name: "invalid modifier", in: "${DIR:}", wantErr: true},
+		{name: "strict set", in: "./$DIR/${CONF}", strict: true, want: "./config/file.conf"},
+		{name: "strict unset", in: "./$UNSET", strict: true, wantErr: true},
+		{name: "strict unset braced", in: "./${UNSET}", strict: true, wantErr: true},
+		{name: "strict unset with default", in: "./${UNSET:-dev}", strict: true, want: "./dev"},
+		{name: "strict empty", in: "./${EMPTY}app", strict: true, want: "./app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := interpolate(tt.in, lookup, tt.strict)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("interpolate(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("interpolate(%q) failed: %s", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("interpolate(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
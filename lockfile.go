@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// lockMismatchError is returned when the generated variables don't match the lockfile, with a diff of the entries
+type lockMismatchError struct {
+	path string
+	diff []string
+}
+
+func (e *lockMismatchError) Error() string {
+	return fmt.Sprintf("the generated variables don't match the lockfile %s, run with --update-lock to accept them:\n%s", e.path, strings.Join(e.diff, "\n"))
+}
+
+// checkLockfile compares the generated KEY=VALUE entries with the ones recorded in the lockfile
+func checkLockfile(path string, env []string) error {
+	locked, err := loadEnvFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("lockfile %s does not exist, create it with --update-lock", path)
+		}
+		return err
+	}
+
+	if diff := diffEnv(newDeployState(locked), newDeployState(env)); len(diff) > 0 {
+		return &lockMismatchError{path: path, diff: diff}
+	}
+
+	return nil
+}
+
+// diffEnv returns the changed entries in diff style, sorted by name: a - line with the expected value and a + line
+// with the actual one
+func diffEnv(expected, actual map[string]string) []string {
+	names := make(map[string]bool, len(expected)+len(actual))
+	for key := range expected {
+		names[key] = true
+	}
+	for key := range actual {
+		names[key] = true
+	}
+
+	keys := make([]string, 0, len(names))
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, key := range keys {
+		want, inExpected := expected[key]
+		got, inActual := actual[key]
+
+		if inExpected && inActual && want == got {
+			continue
+		}
+
+		if inExpected {
+			diff = append(diff, "-"+key+"="+want)
+		}
+		if inActual {
+			diff = append(diff, "+"+key+"="+got)
+		}
+	}
+
+	return diff
+}
+
+// writeLockfile records the generated entries sorted by name
+func writeLockfile(path string, env []string) error {
+	entries := append([]string{}, env...)
+	sort.Strings(entries)
+
+	data := "# Generated by docker-deploy --update-lock, do not edit\n" + strings.Join(entries, "\n") + "\n"
+
+	return writeFileAtomic(path, []byte(data), 0600)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// logLevel is the severity of a log entry
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// logFields are structured values attached to a log entry, they are only shown in the json format
+type logFields map[string]interface{}
+
+// deployLogger writes the wrapper's own log lines either as plain text or as one json object per line
+type deployLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level logLevel
+	json  bool
+	// color adds the level colors to the text lines written to out, the extra outputs never get them
+	color bool
+	extra []io.Writer
+}
+
+// ANSI escape sequences of the level colors
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorYellow = "\x1b[33m"
+	colorRed    = "\x1b[31m"
+)
+
+// logEntry is a log line being built with some fields attached
+type logEntry struct {
+	logger *deployLogger
+	fields logFields
+}
+
+var logger = &deployLogger{out: os.Stderr, level: levelInfo}
+
+// setFormat selects the output format, either text or json
+func (l *deployLogger) setFormat(format string) error {
+	switch format {
+	case "text":
+		l.json = false
+	case "json":
+		l.json = true
+	default:
+		return fmt.Errorf("invalid log format %q, valid values are: text, json", format)
+	}
+
+	return nil
+}
+
+// setColor selects whether the text lines are colored: always, never or auto, which colors them when out is a
+// terminal and the NO_COLOR variable is not set
+func (l *deployLogger) setColor(mode string) error {
+	switch mode {
+	case "always":
+		l.color = true
+	case "never":
+		l.color = false
+	case "auto":
+		l.color = os.Getenv("NO_COLOR") == "" && isTerminal(l.out)
+	default:
+		return fmt.Errorf("invalid color mode %q, valid values are: auto, always, never", mode)
+	}
+
+	return nil
+}
+
+// isTerminal reports whether the reader or writer is a terminal, a character device like /dev/null is not
+func isTerminal(v interface{}) bool {
+	f, ok := v.(*os.File)
+	if !ok {
+		return false
+	}
+
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// addOutput writes the log lines to w too, along with the current output
+func (l *deployLogger) addOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.extra = append(l.extra, w)
+}
+
+// writeLine writes the line to every output, only out gets the color
+func (l *deployLogger) writeLine(line, color string) {
+	if l.color && color != "" {
+		_, _ = fmt.Fprintln(l.out, color+line+colorReset)
+	} else {
+		_, _ = fmt.Fprintln(l.out, line)
+	}
+
+	for _, w := range l.extra {
+		_, _ = fmt.Fprintln(w, line)
+	}
+}
+
+func (l *deployLogger) write(level logLevel, fields logFields, msg string) {
+	if level < l.level {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.json {
+		color := ""
+		switch level {
+		case levelDebug:
+			color = colorDim
+		case levelWarn:
+			msg = "Warning: " + msg
+			color = colorYellow
+		case levelError:
+			color = colorRed
+		}
+		l.writeLine(msg, color)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg})
+	}
+
+	l.writeLine(string(data), "")
+}
+
+// With returns an entry that attaches the given fields to the log line
+func (l *deployLogger) With(fields logFields) *logEntry {
+	return &logEntry{logger: l, fields: fields}
+}
+
+func (l *deployLogger) Debugf(format string, v ...interface{}) {
+	l.write(levelDebug, nil, fmt.Sprintf(format, v...))
+}
+
+func (l *deployLogger) Infof(format string, v ...interface{}) {
+	l.write(levelInfo, nil, fmt.Sprintf(format, v...))
+}
+
+func (l *deployLogger) Warnf(format string, v ...interface{}) {
+	l.write(levelWarn, nil, fmt.Sprintf(format, v...))
+}
+
+func (l *deployLogger) Errorf(format string, v ...interface{}) {
+	l.write(levelError, nil, fmt.Sprintf(format, v...))
+}
+
+// fail logs the error and returns the given exit code, for run to return it
+func (l *deployLogger) fail(code int, v ...interface{}) int {
+	l.write(levelError, nil, fmt.Sprint(v...))
+	return code
+}
+
+// failf logs the message and returns the given exit code, for run to return it
+func (l *deployLogger) failf(code int, format string, v ...interface{}) int {
+	l.write(levelError, nil, fmt.Sprintf(format, v...))
+	return code
+}
+
+func (e *logEntry) Debugf(format string, v ...interface{}) {
+	e.logger.write(levelDebug, e.fields, fmt.Sprintf(format, v...))
+}
+
+func (e *logEntry) Infof(format string, v ...interface{}) {
+	e.logger.write(levelInfo, e.fields, fmt.Sprintf(format, v...))
+}
+
+func (e *logEntry) Warnf(format string, v ...interface{}) {
+	e.logger.write(levelWarn, e.fields, fmt.Sprintf(format, v...))
+}
+
+func (e *logEntry) Errorf(format string, v ...interface{}) {
+	e.logger.write(levelError, e.fields, fmt.Sprintf(format, v...))
+}
@@ -2,25 +2,69 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/crypto/blake2b"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultComposeFile  = "docker-compose.yml"
+	overrideComposeFile = "docker-compose.override.yml"
+)
+
+// configEnvVar names the config file when --config isn't given
+const configEnvVar = "DOCKER_DEPLOY_CONFIG"
+
+// defaultConfigFiles are searched in each directory when no --config is given, in this order
+var defaultConfigFiles = []string{".docker-deploy.yml", ".docker-deploy.yaml", ".docker-deploy.json", ".docker-deploy.toml"}
+
+// Exit codes of the different failure classes, documented in the README so scripts can depend on them.
+// When docker runs and fails its own exit code is used instead.
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitConfig  = 3
+	exitCompose = 4
+	exitDocker  = 5
+	exitHook    = 6
+	exitLock    = 7
+	// exitTimeout is used when docker is killed by --timeout, same as timeout(1)
+	exitTimeout = 124
+	// exitNotFound is used when the docker binary doesn't exist, same as the shells
+	exitNotFound = 127
+)
+
 var (
 	// Tag indicates the commit tag
 	Tag = "none"
@@ -33,261 +77,3332 @@ var (
 )
 
 type appConfig struct {
-	Host string `yaml:"host"`
-}
-
-type configSettings struct {
-	Name string `yaml:"name"`
-	File string `yaml:"file"`
+	Host         string   `yaml:"host" json:"host" toml:"host"`
+	DockerBinary string   `yaml:"docker_binary" json:"docker_binary" toml:"docker_binary"`
+	ComposeFiles []string `yaml:"compose_files" json:"compose_files" toml:"compose_files"`
+	StackName    string   `yaml:"stack_name" json:"stack_name" toml:"stack_name"`
+	Context      string   `yaml:"context" json:"context" toml:"context"`
+	// Production asks for a confirmation before every deploy, unless --yes is given
+	Production bool `yaml:"production" json:"production" toml:"production"`
+	// Prune and RegistryAuth are the defaults of --prune and --with-registry-auth, nil when not set so a closer
+	// config or an environment can set them to false
+	Prune        *bool `yaml:"prune" json:"prune" toml:"prune"`
+	RegistryAuth *bool `yaml:"registry_auth" json:"registry_auth" toml:"registry_auth"`
+	// Environments are named settings selected with --environment, overriding the top level ones
+	Environments map[string]environmentConfig `yaml:"environments" json:"environments" toml:"environments"`
 }
 
-type composeInfo struct {
-	Configs map[string]configSettings `yaml:"configs"`
-	Secrets map[string]configSettings `yaml:"secrets"`
+// environmentConfig are the settings that can be changed for each environment
+type environmentConfig struct {
+	Host      string `yaml:"host" json:"host" toml:"host"`
+	Context   string `yaml:"context" json:"context" toml:"context"`
+	StackName string `yaml:"stack_name" json:"stack_name" toml:"stack_name"`
+	// Production marks the environment as production, on top of the top level setting
+	Production   bool  `yaml:"production" json:"production" toml:"production"`
+	Prune        *bool `yaml:"prune" json:"prune" toml:"prune"`
+	RegistryAuth *bool `yaml:"registry_auth" json:"registry_auth" toml:"registry_auth"`
 }
 
-func fileHash(filePath string) (string, error) {
-	var fileHash string
+// forEnvironment returns the config with the settings of the named environment applied. The host and context
+// select the daemon together, so setting either in the environment replaces both top level settings.
+func (c *appConfig) forEnvironment(name string) (*appConfig, error) {
+	env, ok := c.Environments[name]
+	if !ok {
+		return nil, fmt.Errorf("environment %s is not defined in the config file", name)
+	}
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fileHash, err
+	cfg := *c
+	if env.Host != "" || env.Context != "" {
+		cfg.Host = env.Host
+		cfg.Context = env.Context
 	}
 
-	defer func() { _ = file.Close() }()
+	if env.StackName != "" {
+		cfg.StackName = env.StackName
+	}
 
-	hash := sha256.New()
+	cfg.Production = cfg.Production || env.Production
 
-	if _, err := io.Copy(hash, file); err != nil {
-		return fileHash, err
+	if env.Prune != nil {
+		cfg.Prune = env.Prune
 	}
 
-	hashBytes := hash.Sum(nil)[:8]
-	fileHash = hex.EncodeToString(hashBytes)
+	if env.RegistryAuth != nil {
+		cfg.RegistryAuth = env.RegistryAuth
+	}
 
-	return fileHash, nil
+	return &cfg, nil
 }
 
-func newFileEnvironment(filePath string) (string, error) {
-	variable := strings.ToUpper(path.Base(filePath))
+// merge applies the settings of a config closer to the current directory. The values that are set replace the
+// current ones, the compose files as a whole since they are resolved from the current directory, and the
+// environments are merged by name. The host and context select the daemon together, like with the environments.
+func (c *appConfig) merge(other *appConfig) {
+	if other.Host != "" || other.Context != "" {
+		c.Host = other.Host
+		c.Context = other.Context
+	}
 
-	re := regexp.MustCompile(`[^A-Z0-9_]`)
-	variable = re.ReplaceAllString(variable, "_")
+	if other.DockerBinary != "" {
+		c.DockerBinary = other.DockerBinary
+	}
 
-	version, err := fileHash(filePath)
-	if err != nil {
-		return "", err
+	if len(other.ComposeFiles) > 0 {
+		c.ComposeFiles = other.ComposeFiles
 	}
 
-	return fmt.Sprintf("%s=%s", variable, version), nil
-}
+	if other.StackName != "" {
+		c.StackName = other.StackName
+	}
 
-func environmentFromYaml(yamlFile []byte) ([]string, error) {
-	var environment []string
-	var cfg composeInfo
+	// a parent marked as production can only be made safer
+	c.Production = c.Production || other.Production
 
-	err := yaml.Unmarshal(yamlFile, &cfg)
-	if err != nil {
-		return environment, err
+	if other.Prune != nil {
+		c.Prune = other.Prune
 	}
 
-	for _, v := range cfg.Configs {
-		if v.Name != "" {
-			env, err := newFileEnvironment(v.File)
-			if err != nil {
-				log.Printf("Cannot generate environment for config file %s: %s", v.File, err.Error())
-			} else {
-				log.Printf("Using config %s\n", env)
-				environment = append(environment, env)
-			}
-		}
+	if other.RegistryAuth != nil {
+		c.RegistryAuth = other.RegistryAuth
 	}
 
-	for _, v := range cfg.Secrets {
-		if v.Name != "" {
-			env, err := newFileEnvironment(v.File)
-			if err != nil {
-				log.Printf("Cannot generate environment for secret file %s: %s", v.File, err.Error())
-			} else {
-				log.Printf("Using secret %s\n", env)
-				environment = append(environment, env)
-			}
+	for name, env := range other.Environments {
+		if c.Environments == nil {
+			c.Environments = make(map[string]environmentConfig)
+		}
+
+		merged, ok := c.Environments[name]
+		if !ok {
+			c.Environments[name] = env
+			continue
+		}
+
+		if env.Host != "" || env.Context != "" {
+			merged.Host = env.Host
+			merged.Context = env.Context
+		}
+
+		if env.StackName != "" {
+			merged.StackName = env.StackName
+		}
+
+		merged.Production = merged.Production || env.Production
+
+		if env.Prune != nil {
+			merged.Prune = env.Prune
+		}
+
+		if env.RegistryAuth != nil {
+			merged.RegistryAuth = env.RegistryAuth
 		}
+
+		c.Environments[name] = merged
 	}
+}
 
-	return environment, nil
+type configSettings struct {
+	Name     string   `yaml:"name"`
+	File     string   `yaml:"file"`
+	Content  string   `yaml:"content"`
+	External external `yaml:"external"`
+	// HashAlgo and HashLength override the global hash options for this entry only
+	HashAlgo   string `yaml:"x-hash-algo"`
+	HashLength int    `yaml:"x-hash-length"`
+	// Environments restricts the entry to these --environment values, it applies to all of them when empty
+	Environments []string `yaml:"x-environments"`
 }
 
-func loadEnvFromConfigFiles(filenames []string, stdin io.Reader) ([]string, error) {
-	var envs []string
+// hashOptions returns the hash options for this entry, falling back to the global ones for unset fields
+func (c configSettings) hashOptions(defaults hashOptions) hashOptions {
+	opts := defaults
+	if c.HashAlgo != "" {
+		opts.Algo = c.HashAlgo
+	}
+	if c.HashLength != 0 {
+		opts.Length = c.HashLength
+	}
 
-	for _, filename := range filenames {
-		env, err := loadEnvFromConfigFile(filename, stdin)
-		if err != nil {
-			return envs, err
+	return opts
+}
+
+// external is the external field of a config or secret, it accepts a boolean or the legacy `external: {name: ...}` form
+type external bool
+
+func (e *external) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		*e = true
+		return nil
+	}
+
+	var b bool
+	if err := value.Decode(&b); err != nil {
+		return err
+	}
+
+	*e = external(b)
+
+	return nil
+}
+
+type composeInfo struct {
+	Include []composeInclude          `yaml:"include"`
+	Configs map[string]configSettings `yaml:"configs"`
+	Secrets map[string]configSettings `yaml:"secrets"`
+}
+
+// composeInclude is an entry of the top level include list, either a path or a mapping whose path is a single file
+// or a list of files
+type composeInclude struct {
+	Paths []string
+}
+
+func (i *composeInclude) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		i.Paths = []string{value.Value}
+		return nil
+	case yaml.MappingNode:
+		var entry struct {
+			Path yaml.Node `yaml:"path"`
 		}
-		envs = append(envs, env...)
+		if err := value.Decode(&entry); err != nil {
+			return err
+		}
+
+		// yaml.Node fields receive aliases as is, they have to be resolved by hand
+		path := &entry.Path
+		for path.Kind == yaml.AliasNode {
+			path = path.Alias
+		}
+
+		switch path.Kind {
+		case yaml.ScalarNode:
+			i.Paths = []string{path.Value}
+			return nil
+		case yaml.SequenceNode:
+			return path.Decode(&i.Paths)
+		default:
+			return fmt.Errorf("line %d: include entry without a path", value.Line)
+		}
+	default:
+		return fmt.Errorf("line %d: invalid include entry", value.Line)
 	}
+}
 
-	return envs, nil
+// hashAlgorithms maps the values accepted by --hash-algo to their digest constructors
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"md5":    md5.New,
+	"blake2b": func() hash.Hash {
+		// only fails when given a key longer than 64 bytes
+		h, _ := blake2b.New512(nil)
+		return h
+	},
 }
 
-func loadEnvFromConfigFile(filename string, stdin io.Reader) ([]string, error) {
-	var yamlFile []byte
-	var err error
+// hashOptions controls how the version string of a file is computed
+type hashOptions struct {
+	// Algo is the digest algorithm name, one of the keys of hashAlgorithms
+	Algo string
+	// Length is the number of digest bytes kept, the version string has twice this many characters
+	Length int
+	// Cache holds the digests of previously hashed files, nil to always read the files
+	Cache *hashCache
+	// Memo holds the digests already computed by this run, so a file is only read once
+	Memo *hashMemo
+	// NormalizeEOL replaces CRLF line endings with LF before hashing
+	NormalizeEOL bool
+	// Source is content to hash the files with Algo, or git-blob to use the git blob id of the tracked ones
+	Source string
+	// MaxFileSize is the size in bytes of the largest file that can be hashed, there is no limit when 0
+	MaxFileSize int64
+}
 
-	if filename == "-" {
-		yamlFile, err = ioutil.ReadAll(stdin)
-	} else {
-		yamlFile, err = ioutil.ReadFile(filename)
+// checkFileSize rejects the files larger than --max-file-size before they are read
+func (o hashOptions) checkFileSize(filePath string, info os.FileInfo) error {
+	if o.MaxFileSize > 0 && info.Size() > o.MaxFileSize {
+		return fmt.Errorf("%s is %s, larger than the maximum of %s, see --max-file-size", filePath, formatByteSize(info.Size()), formatByteSize(o.MaxFileSize))
 	}
 
-	if err != nil {
-		return nil, err
+	return nil
+}
+
+// cacheAlgo is the algorithm name used in the cache keys, normalized digests are cached apart from the exact ones
+func (o hashOptions) cacheAlgo() string {
+	if o.Source == hashSourceGitBlob {
+		return o.Source + "+" + o.Algo
+	}
+
+	if o.NormalizeEOL {
+		return o.Algo + "+lf"
 	}
 
-	return environmentFromYaml(yamlFile)
+	return o.Algo
 }
 
-func loadAppConfig(filename string) (*appConfig, error) {
-	cfg := &appConfig{}
-	targetPath, err := os.Getwd()
-	if err != nil {
-		return nil, err
+// copyContent writes the content of r to the hash, replacing CRLF with LF when normalize is set
+func copyContent(hash io.Writer, r io.Reader, normalize bool) error {
+	if !normalize {
+		_, err := io.Copy(hash, r)
+		return err
 	}
 
-	rootDir := filepath.Join(filepath.VolumeName(targetPath), "/")
+	w := &eolWriter{out: hash}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
 
-	for {
-		configPath := filepath.Join(targetPath, filename)
-		data, err := ioutil.ReadFile(configPath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				if targetPath == rootDir {
-					return cfg, nil
-				}
-				targetPath = filepath.Dir(targetPath)
-				continue
+	return w.flush()
+}
+
+// eolWriter replaces CRLF with LF in a stream, a CR at the end of a write is held until the next byte is known
+type eolWriter struct {
+	out io.Writer
+	cr  bool
+}
+
+func (w *eolWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+1)
+
+	for _, b := range p {
+		if w.cr {
+			w.cr = false
+			if b != '\n' {
+				buf = append(buf, '\r')
 			}
-			break
 		}
 
-		log.Printf("Reading config file: %s", configPath)
-		err = yaml.Unmarshal(data, cfg)
-		if err != nil {
-			break
+		if b == '\r' {
+			w.cr = true
+			continue
 		}
 
-		return cfg, nil
+		buf = append(buf, b)
 	}
 
-	return nil, err
+	if _, err := w.out.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
 }
 
-func loadVersionInfo() {
-	info, ok := debug.ReadBuildInfo()
-	if ok {
-		for _, setting := range info.Settings {
-			switch setting.Key {
-			case "vcs.revision":
-				Revision = setting.Value
-			case "vcs.time":
-				LastCommit, _ = time.Parse(time.RFC3339, setting.Value)
-			case "vcs.modified":
-				Modified = setting.Value == "true"
-			}
+// flush writes the CR held at the end of the stream
+func (w *eolWriter) flush() error {
+	if !w.cr {
+		return nil
+	}
+
+	w.cr = false
+	_, err := w.out.Write([]byte{'\r'})
+
+	return err
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	newFunc, ok := hashAlgorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, valid values are: sha256, sha512, md5, blake2b", algo)
+	}
+
+	return newFunc(), nil
+}
+
+func (o hashOptions) validate() error {
+	hash, err := newHash(o.Algo)
+	if err != nil {
+		return err
+	}
+
+	if o.Length < 1 || o.Length > 32 {
+		return fmt.Errorf("invalid hash length %d, must be between 1 and 32 bytes", o.Length)
+	}
+
+	if o.Length > hash.Size() {
+		return fmt.Errorf("invalid hash length %d, %s digests are only %d bytes long", o.Length, o.Algo, hash.Size())
+	}
+
+	switch o.Source {
+	case "", hashSourceContent:
+	case hashSourceGitBlob:
+		if o.Length > sha1.Size {
+			return fmt.Errorf("invalid hash length %d, git blob ids are only %d bytes long", o.Length, sha1.Size)
 		}
+		if o.NormalizeEOL {
+			return errors.New("the line endings cannot be normalized with git blob ids, git hashes the files as they are")
+		}
+	default:
+		return fmt.Errorf("invalid hash source %q, valid values are: content, git-blob", o.Source)
 	}
+
+	return nil
 }
 
-var auth = flag.BoolP("with-registry-auth", "a", false, "Send registry authentication details to Swarm agents")
-var prune = flag.BoolP("prune", "p", false, "Prune services that are no longer referenced")
-var host = flag.StringP("host", "H", "", "Daemon socket(s) to connect to")
-var composeFiles = flag.StringSliceP("compose-file", "c", []string{"docker-compose.yml"}, "Path to a Compose file, or '-' to read from stdin")
-var version = flag.BoolP("version", "v", false, "Show version")
+func fileHash(filePath string, opts hashOptions) (string, error) {
+	var fileHash string
 
-func main() {
-	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
-	err := flag.CommandLine.Parse(os.Args[1:])
-	log.SetFlags(0)
+	if err := opts.validate(); err != nil {
+		return fileHash, err
+	}
 
-	if err == flag.ErrHelp {
-		os.Exit(0)
-	} else if err != nil {
-		log.Fatal(err)
+	// the untracked files fall back to the content, the memo still has them under the requested source
+	memoAlgo := opts.cacheAlgo()
+
+	if opts.Memo != nil {
+		if digest, ok := opts.Memo.lookup(filePath, memoAlgo); ok {
+			trace.Printf("Reusing the %s hash of %s computed earlier in the run", opts.Algo, filePath)
+			return hex.EncodeToString(digest[:opts.Length]), nil
+		}
 	}
 
-	if *version {
-		loadVersionInfo()
-		fmt.Printf("docker-deploy version: %s, commit: %s, date: %s, clean build: %t\n", Tag, Revision, LastCommit, Modified)
-		return
+	hash, err := newHash(opts.Algo)
+	if err != nil {
+		return fileHash, err
 	}
 
-	cfg, err := loadAppConfig(".docker-deploy.yml")
+	// checked before opening the file, which would block on a named pipe
+	info, err := os.Stat(filePath)
 	if err != nil {
-		log.Fatal(err)
+		trace.Printf("Cannot stat %s: %s", filePath, err)
+		return fileHash, err
 	}
 
-	var buf bytes.Buffer
-	tee := io.TeeReader(os.Stdin, &buf)
-	env, err := loadEnvFromConfigFiles(*composeFiles, tee)
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return fileHash, fmt.Errorf("cannot hash %s: not a regular file or a directory", filePath)
+		}
+		if err := opts.checkFileSize(filePath, info); err != nil {
+			return fileHash, err
+		}
+	}
+
+	trace.Printf("Opening %s to hash it with %s", filePath, opts.Algo)
+	file, err := os.Open(filePath)
 	if err != nil {
-		log.Fatal(err)
+		trace.Printf("Cannot open %s: %s", filePath, err)
+		return fileHash, err
 	}
 
-	args := []string{"stack", "deploy"}
-	for _, composeFile := range *composeFiles {
-		args = append(args, "--compose-file", composeFile)
+	defer func() { _ = file.Close() }()
+
+	info, err = file.Stat()
+	if err != nil {
+		return fileHash, err
+	}
+
+	// the modification time of a directory doesn't change with its files so directories are never cached
+	if info.IsDir() {
+		if err := hashDirectory(hash, filePath, opts); err != nil {
+			return fileHash, err
+		}
+
+		digest := hash.Sum(nil)
+		if opts.Memo != nil {
+			opts.Memo.store(filePath, memoAlgo, digest)
+		}
+		return hex.EncodeToString(digest[:opts.Length]), nil
 	}
 
-	if *host != "" {
-		args = append([]string{"--host", *host}, args...)
-	} else if cfg.Host != "" {
-		args = append([]string{"--host", cfg.Host}, args...)
+	// directories have no blob id, they are always hashed from their content
+	if opts.Source == hashSourceGitBlob {
+		if gitTracked(filePath) {
+			hash = gitBlobHash(info.Size())
+		} else {
+			logger.With(logFields{"file": filePath}).Debugf("File %s is not tracked by git, hashing its content with %s", filePath, opts.Algo)
+			opts.Source = hashSourceContent
+		}
 	}
 
-	if *auth {
-		args = append(args, "--with-registry-auth")
+	if opts.Cache != nil {
+		if digest, ok := opts.Cache.lookup(filePath, opts.cacheAlgo(), info); ok {
+			logger.With(logFields{"file": filePath}).Debugf("Using cached hash of %s", filePath)
+			return hex.EncodeToString(digest[:opts.Length]), nil
+		}
 	}
 
-	if *prune {
-		args = append(args, "--prune")
+	if err := copyContent(hash, file, opts.NormalizeEOL); err != nil {
+		return fileHash, err
+	}
+
+	digest := hash.Sum(nil)
+	if opts.Cache != nil {
+		opts.Cache.store(filePath, opts.cacheAlgo(), info, digest)
+	}
+	if opts.Memo != nil {
+		opts.Memo.store(filePath, memoAlgo, digest)
+	}
+
+	hashBytes := digest[:opts.Length]
+	fileHash = hex.EncodeToString(hashBytes)
+
+	return fileHash, nil
+}
+
+// contentHash returns the truncated digest of the data, like fileHash does for a file
+func contentHash(data []byte, opts hashOptions) (string, error) {
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+
+	hash, err := newHash(opts.Algo)
+	if err != nil {
+		return "", err
+	}
+
+	if err := copyContent(hash, bytes.NewReader(data), opts.NormalizeEOL); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)[:opts.Length]), nil
+}
+
+// hashDirectory folds every entry of the directory tree into the hash, walking it in lexical order so the result
+// doesn't depend on the filesystem. Each entry contributes its kind and slash separated relative path, files add the
+// digest of their content and symlinks their target, without being followed. Any other file type or an error reading
+// the tree, like a permission error, fails the hash. The paths matching the .deployignore file of the directory are
+// left out, along with the ignore file itself.
+func hashDirectory(hash hash.Hash, dir string, opts hashOptions) error {
+	rules, err := loadIgnoreRules(dir)
+	if err != nil {
+		return err
 	}
 
-	if len(flag.Args()) == 0 {
-		dirname, err := os.Getwd()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Fatalf("No stack name provided and cannot read the current directory: %s", err.Error())
+			return err
 		}
 
-		args = append(args, filepath.Base(dirname))
-	} else {
-		args = append(args, flag.Args()...)
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if rel == deployIgnoreFile || rules.ignored(rel, d.IsDir()) {
+			// the content of an ignored directory cannot be included back
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+			_, _ = fmt.Fprintf(hash, "dir\x00%s\n", rel)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(hash, "link\x00%s\x00%s\n", rel, filepath.ToSlash(target))
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := opts.checkFileSize(path, info); err != nil {
+				return err
+			}
+
+			content, err := newHash(opts.Algo)
+			if err != nil {
+				return err
+			}
+
+			trace.Printf("Opening %s to hash it with %s", path, opts.Algo)
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			err = copyContent(content, file, opts.NormalizeEOL)
+			_ = file.Close()
+			if err != nil {
+				return err
+			}
+
+			_, _ = fmt.Fprintf(hash, "file\x00%s\x00%x\n", rel, content.Sum(nil))
+		default:
+			return fmt.Errorf("cannot hash %s: unsupported file type", path)
+		}
+
+		return nil
+	})
+}
+
+// defaultEnvNameTemplate names the variables after the basename of the referenced file
+const defaultEnvNameTemplate = "{{.Base}}"
+
+// envOptions controls how the environment variables are generated from a compose file
+type envOptions struct {
+	Hash hashOptions
+	// NameTemplate renders the variable name of each config or secret from an envNameData
+	NameTemplate *template.Template
+	// Prefix is prepended to every generated variable name, already sanitized
+	Prefix string
+	// FailOnCollision turns a variable generated twice with different values into an error
+	FailOnCollision bool
+	// OnMissingFile is what to do when a referenced file doesn't exist, one of skip, warn or fail
+	OnMissingFile string
+	// Lookup returns the variables interpolated in the file paths, no interpolation is done when nil
+	Lookup lookupFunc
+	// StrictInterpolation turns unset variables in the file paths into an error
+	StrictInterpolation bool
+	// Concurrency is the maximum number of files hashed at the same time
+	Concurrency int
+	// BaseDir is the directory relative file paths are resolved against, the one of the compose file being read.
+	// When empty they are relative to the current directory.
+	BaseDir string
+	// PreviousState holds the variables of the last successful deploy, the differences are logged when it is set
+	PreviousState deployState
+	// Ignore are glob patterns of the config and secret names that don't generate a variable
+	Ignore []string
+	// FingerprintName is the variable holding the hash of all the generated ones, it isn't added when empty
+	FingerprintName string
+	// File is the compose file being read, to record its annotations
+	File string
+	// Annotations collects the variable of every config and secret for --annotate, nothing is recorded when nil
+	Annotations *composeAnnotations
+	// CheckPermissions warns about the secret files readable by other users, StrictPermissions fails instead
+	CheckPermissions  bool
+	StrictPermissions bool
+	// StdinName is shown instead of - for the compose file read from stdin, its directory is the base of the relative
+	// paths of that file
+	StdinName string
+	// Environment is the selected --environment, the entries restricted to other environments are skipped. Every
+	// entry is hashed when empty.
+	Environment string
+	// KnownEnvironments are the environments of the config file, the other names listed by the entries are reported
+	KnownEnvironments map[string]environmentConfig
+}
+
+// checkSecretPermissions reports a secret file that other users can access. Windows files don't have these modes so
+// they are never checked, and a missing file is left to the --on-missing-file handling.
+func checkSecretPermissions(name, filePath string, strict bool) error {
+	if runtime.GOOS == "windows" {
+		return nil
 	}
 
-	log.Printf("Running: docker %v", strings.Join(args, " "))
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
 
-	cmd := exec.Command("docker", args...)
+	mode := info.Mode().Perm()
+	if mode&0077 == 0 {
+		return nil
+	}
 
-	if len(env) > 0 {
-		cmd.Env = append(os.Environ(), env...)
+	if strict {
+		return fmt.Errorf("secret %s file %s can be accessed by other users (mode %04o), restrict it to 0600", name, filePath, mode)
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	logger.With(logFields{"file": filePath}).
+		Warnf("Secret %s file %s can be accessed by other users (mode %04o), restrict it to 0600", name, filePath, mode)
+	return nil
+}
 
-	if buf.Len() > 0 {
-		cmd.Stdin = &buf
-	} else {
-		cmd.Stdin = os.Stdin
+// ignored returns the --ignore pattern matching the config or secret name, if any
+func (o envOptions) ignored(name string) (string, bool) {
+	for _, pattern := range o.Ignore {
+		// the patterns were validated when parsing the flags
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern, true
+		}
 	}
 
-	err = cmd.Run()
-	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exiterr.ExitCode())
-		} else {
-			log.Fatal(err)
+	return "", false
+}
+
+// skippedEnvironment reports whether the entry is restricted to other environments than the selected one
+func (o envOptions) skippedEnvironment(kind, name string, environments []string) bool {
+	if len(environments) == 0 {
+		return false
+	}
+
+	selected := false
+	for _, env := range environments {
+		// the names are free when the config file doesn't define any environment
+		if _, ok := o.KnownEnvironments[env]; !ok && len(o.KnownEnvironments) > 0 {
+			logger.Warnf("The %s %s lists the environment %s, which is not defined in the config file", kind, name, env)
+		}
+		if env == o.Environment {
+			selected = true
 		}
 	}
+
+	return o.Environment != "" && !selected
+}
+
+// resolvePath returns the path of a file referenced by the compose file
+func (o envOptions) resolvePath(filePath string) string {
+	if o.BaseDir == "" || filepath.IsAbs(filePath) {
+		return filePath
+	}
+
+	return filepath.Join(o.BaseDir, filePath)
+}
+
+const (
+	missingFileSkip = "skip"
+	missingFileWarn = "warn"
+	missingFileFail = "fail"
+)
+
+func validateOnMissingFile(value string) error {
+	switch value {
+	case missingFileSkip, missingFileWarn, missingFileFail:
+		return nil
+	default:
+		return fmt.Errorf("invalid --on-missing-file value %q, valid values are: skip, warn, fail", value)
+	}
+}
+
+// envNameData is the data available to the --env-name-template template
+type envNameData struct {
+	// Name is the key of the config or secret in the compose file
+	Name string
+	// File is the path of the referenced file as written in the compose file
+	File string
+	// Base is the last element of File
+	Base string
+}
+
+func parseEnvNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("env-name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment name template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// invalidEnvChars matches the characters that are replaced with an underscore in the generated variable names
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// validateEnvName checks a variable name given in the command line, it is used as is unlike the prefix
+func validateEnvName(name string) error {
+	if name == "" || invalidEnvChars.MatchString(name) || (name[0] >= '0' && name[0] <= '9') {
+		return fmt.Errorf("invalid variable name %q, use uppercase letters, digits and underscores", name)
+	}
+
+	return nil
+}
+
+// sanitizeEnvPrefix sanitizes the prefix like the variable names and checks it can start a variable name
+func sanitizeEnvPrefix(prefix string) (string, error) {
+	sanitized := invalidEnvChars.ReplaceAllString(strings.ToUpper(prefix), "_")
+
+	if sanitized != "" && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		return "", fmt.Errorf("invalid environment prefix %q, a variable name cannot start with a digit", prefix)
+	}
+
+	return sanitized, nil
+}
+
+func newFileEnvironment(name, filePath string, opts envOptions) (string, error) {
+	variable, err := envName(name, envNameData{Name: name, File: filePath, Base: path.Base(filePath)}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	version, err := fileHash(opts.resolvePath(filePath), opts.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s=%s", variable, version), nil
+}
+
+// newContentEnvironment versions an inline content, the name of the entry is used as .Base since there is no file
+func newContentEnvironment(name, content string, opts envOptions) (string, error) {
+	variable, err := envName(name, envNameData{Name: name, Base: name}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	version, err := contentHash([]byte(content), opts.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s=%s", variable, version), nil
+}
+
+// envName renders the sanitized and prefixed variable name of an entry
+func envName(name string, data envNameData, opts envOptions) (string, error) {
+	var sb strings.Builder
+
+	if err := opts.NameTemplate.Execute(&sb, data); err != nil {
+		return "", err
+	}
+
+	variable := strings.ToUpper(sb.String())
+
+	variable = invalidEnvChars.ReplaceAllString(variable, "_")
+
+	if variable == "" {
+		return "", fmt.Errorf("environment name template rendered an empty name for %s", name)
+	}
+
+	return opts.Prefix + variable, nil
+}
+
+func environmentFromCompose(cfg composeInfo, opts envOptions) ([]string, error) {
+	var environment []string
+
+	configJobs, err := hashJobsFromSettings("config", cfg.Configs, opts)
+	if err != nil {
+		return environment, err
+	}
+
+	secretJobs, err := hashJobsFromSettings("secret", cfg.Secrets, opts)
+	if err != nil {
+		return environment, err
+	}
+
+	jobs := append(configJobs, secretJobs...)
+	runHashJobs(jobs, opts.Concurrency)
+
+	// the results are handled in order once every file is hashed, so the logs and variables are deterministic
+	generated := make(map[string]bool)
+	for _, job := range jobs {
+		if job.err != nil {
+			// only a missing file can be ignored, any other error means the file cannot be versioned
+			if !errors.Is(job.err, os.ErrNotExist) {
+				return environment, fmt.Errorf("cannot generate environment for %s file %s: %w", job.kind, job.filePath, job.err)
+			}
+
+			switch opts.OnMissingFile {
+			case missingFileSkip:
+				logger.With(logFields{"file": job.filePath}).Debugf("Skipping missing %s file %s", job.kind, job.filePath)
+			case missingFileFail:
+				return environment, fmt.Errorf("cannot generate environment for %s file %s: %w", job.kind, job.filePath, job.err)
+			default:
+				logger.With(logFields{"file": job.filePath}).Warnf("Cannot generate environment for %s file %s: %s", job.kind, job.filePath, job.err.Error())
+			}
+			continue
+		}
+
+		if opts.Annotations != nil {
+			opts.Annotations.add(opts.File, job.kind, job.name, job.env)
+		}
+
+		// entries sharing a definition through yaml anchors reference the same file
+		if generated[job.env] {
+			logger.With(logFields{"file": job.filePath, "env": []string{job.env}}).Debugf("Already using %s %s", job.kind, job.env)
+			continue
+		}
+		generated[job.env] = true
+
+		logger.With(logFields{"file": job.filePath, "env": []string{job.env}}).Debugf("Using %s %s", job.kind, job.env)
+		environment = append(environment, job.env)
+	}
+
+	return environment, nil
+}
+
+// hashJob is a config or secret whose file has to be hashed, with the result once done
+type hashJob struct {
+	kind string
+	name string
+	// file is the path as written in the compose file after interpolation, filePath the resolved one
+	file     string
+	filePath string
+	// content is set for an inline content, which is hashed instead of a file
+	content *string
+	opts    envOptions
+
+	env string
+	err error
+}
+
+// hashJobsFromSettings returns the jobs for the configs or secrets of a compose file sorted by name,
+// kind is used in the logs
+func hashJobsFromSettings(kind string, settings map[string]configSettings, opts envOptions) ([]*hashJob, error) {
+	var jobs []*hashJob
+
+	names := make([]string, 0, len(settings))
+	for k := range settings {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		v := settings[k]
+
+		if v.External {
+			logger.Debugf("Skipping external %s %s", kind, k)
+			continue
+		}
+
+		if pattern, ok := opts.ignored(k); ok {
+			logger.Debugf("Ignoring %s %s, it matches --ignore %s", kind, k, pattern)
+			continue
+		}
+
+		if opts.skippedEnvironment(kind, k, v.Environments) {
+			logger.Debugf("Skipping %s %s, it is not used by the %s environment", kind, k, opts.Environment)
+			continue
+		}
+
+		if v.File != "" && v.Content != "" {
+			return jobs, fmt.Errorf("%s %s is ambiguous, it sets both file and content", kind, k)
+		}
+
+		if v.Name != "" && v.File == "" && v.Content == "" {
+			logger.Debugf("Skipping %s %s without a file", kind, k)
+			continue
+		}
+
+		if v.Name != "" && v.Content != "" {
+			content := v.Content
+			if opts.Lookup != nil {
+				var err error
+				content, err = interpolate(v.Content, opts.Lookup, opts.StrictInterpolation)
+				if err != nil {
+					return jobs, fmt.Errorf("cannot interpolate the content of %s %s: %w", kind, k, err)
+				}
+			}
+
+			entryOpts := opts
+			entryOpts.Hash = v.hashOptions(opts.Hash)
+			if err := entryOpts.Hash.validate(); err != nil {
+				return jobs, fmt.Errorf("invalid hash options for %s %s: %w", kind, k, err)
+			}
+
+			jobs = append(jobs, &hashJob{kind: kind, name: k, content: &content, opts: entryOpts})
+		} else if v.Name != "" {
+			file := v.File
+			if opts.Lookup != nil {
+				var err error
+				file, err = interpolate(v.File, opts.Lookup, opts.StrictInterpolation)
+				if err != nil {
+					return jobs, fmt.Errorf("cannot interpolate the file of %s %s: %w", kind, k, err)
+				}
+			}
+
+			entryOpts := opts
+			entryOpts.Hash = v.hashOptions(opts.Hash)
+			if err := entryOpts.Hash.validate(); err != nil {
+				return jobs, fmt.Errorf("invalid hash options for %s %s: %w", kind, k, err)
+			}
+
+			if kind == "secret" && opts.CheckPermissions {
+				if err := checkSecretPermissions(k, opts.resolvePath(file), opts.StrictPermissions); err != nil {
+					return jobs, err
+				}
+			}
+
+			jobs = append(jobs, &hashJob{kind: kind, name: k, file: file, filePath: opts.resolvePath(file), opts: entryOpts})
+		}
+	}
+
+	return jobs, nil
+}
+
+// runHashJobs hashes the files of the jobs using at most concurrency goroutines
+func runHashJobs(jobs []*hashJob, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// the files are hashed in a batch first, so a file referenced by several entries is only read once even when
+	// they run at the same time, the entries then find their digest in the memo
+	var files []memoFile
+	for _, job := range jobs {
+		if job.content == nil && job.opts.Hash.Memo != nil {
+			files = append(files, memoFile{path: job.filePath, opts: job.opts.Hash})
+		}
+	}
+	if len(files) > 0 {
+		files[0].opts.Memo.hashFiles(files, concurrency)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(job *hashJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if job.content != nil {
+				job.env, job.err = newContentEnvironment(job.name, *job.content, job.opts)
+			} else {
+				job.env, job.err = newFileEnvironment(job.name, job.file, job.opts)
+			}
+		}(job)
+	}
+
+	wg.Wait()
+}
+
+func loadEnvFromConfigFiles(filenames []string, stdin io.Reader, opts envOptions) ([]string, error) {
+	var envs []string
+	var names []string
+	seen := make(map[string]string)
+
+	// a file referenced by several compose files, like an override, is only read once
+	if opts.Hash.Memo == nil {
+		opts.Hash.Memo = newHashMemo()
+	}
+
+	for _, filename := range filenames {
+		env, err := loadEnvFromConfigFile(filename, stdin, opts)
+		if err != nil {
+			return envs, err
+		}
+
+		for _, entry := range env {
+			key, value, _ := strings.Cut(entry, "=")
+			previous, ok := seen[key]
+			if !ok {
+				names = append(names, key)
+			} else if previous == value {
+				logger.With(logFields{"env": []string{entry}}).Debugf("Variable %s is also generated by %s", key, filename)
+			} else {
+				if opts.FailOnCollision {
+					return envs, fmt.Errorf("environment variable %s is generated with different values (%s and %s)", key, previous, value)
+				}
+				logger.With(logFields{"env": []string{key + "=" + previous, entry}}).Warnf("Environment variable %s is generated with different values (%s and %s), using the last one", key, previous, value)
+			}
+			seen[key] = value
+		}
+	}
+
+	// each variable is only given once, in the order it first appeared
+	for _, key := range names {
+		envs = append(envs, key+"="+seen[key])
+	}
+
+	if opts.FingerprintName != "" && len(seen) > 0 {
+		fingerprint, err := fingerprintEnv(seen, opts.Hash)
+		if err != nil {
+			return envs, err
+		}
+
+		logger.Debugf("Deploy fingerprint %s=%s", opts.FingerprintName, fingerprint)
+		envs = append(envs, opts.FingerprintName+"="+fingerprint)
+		seen[opts.FingerprintName] = fingerprint
+	}
+
+	if opts.PreviousState != nil {
+		opts.PreviousState.logChanges(seen)
+	}
+
+	return envs, nil
+}
+
+// fingerprintEnv hashes the sorted KEY=VALUE lines of the generated variables, so a single value changes whenever any
+// config or secret does
+func fingerprintEnv(values map[string]string, opts hashOptions) (string, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(key + "=" + values[key] + "\n")
+	}
+
+	// the line endings are the ones written above
+	opts.NormalizeEOL = false
+
+	return contentHash(buf.Bytes(), opts)
+}
+
+func loadEnvFromConfigFile(filename string, stdin io.Reader, opts envOptions) ([]string, error) {
+	return loadEnvFromComposeFile(filename, stdin, opts, nil)
+}
+
+// loadEnvFromComposeFile generates the environment of a compose file and of the files it includes.
+// The chain holds the absolute paths of the files that are being loaded, to detect include cycles.
+func loadEnvFromComposeFile(filename string, stdin io.Reader, opts envOptions, chain []string) ([]string, error) {
+	var yamlFile []byte
+	var err error
+
+	if filename == "-" {
+		yamlFile, err = ioutil.ReadAll(stdin)
+	} else {
+		yamlFile, err = ioutil.ReadFile(filename)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := composeFileName(filename, opts.StdinName)
+
+	docs, err := parseComposeDocuments(yamlFile)
+	if err != nil {
+		trace.Printf("Cannot parse compose file %s: %s", name, err)
+		return nil, &ComposeParseError{File: name, Err: err}
+	}
+	trace.Printf("Parsed compose file %s: %d bytes, %d documents", name, len(yamlFile), len(docs))
+
+	// referenced paths are relative to the compose file, stdin is relative to the current directory unless named
+	baseDir := "."
+	if filename != "-" {
+		baseDir = filepath.Dir(filename)
+	} else if opts.StdinName != "" {
+		baseDir = filepath.Dir(opts.StdinName)
+	}
+
+	fileOpts := opts
+	fileOpts.BaseDir = baseDir
+	fileOpts.File = filename
+
+	var environment []string
+	var includes []composeInclude
+
+	for _, cfg := range docs {
+		env, err := environmentFromCompose(cfg, fileOpts)
+		if err != nil {
+			return environment, err
+		}
+
+		environment = append(environment, env...)
+		includes = append(includes, cfg.Include...)
+	}
+
+	if len(includes) == 0 {
+		return environment, nil
+	}
+
+	if filename != "-" {
+		absPath, err := filepath.Abs(filename)
+		if err != nil {
+			return environment, err
+		}
+		chain = append(chain, absPath)
+	}
+
+	for _, include := range includes {
+		for _, includePath := range include.Paths {
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(baseDir, includePath)
+			}
+
+			absPath, err := filepath.Abs(includePath)
+			if err != nil {
+				return environment, err
+			}
+
+			for _, parent := range chain {
+				if parent == absPath {
+					return environment, fmt.Errorf("include cycle detected: %s includes %s", name, includePath)
+				}
+			}
+
+			if _, err := os.Stat(includePath); err != nil {
+				return environment, fmt.Errorf("cannot include %s from %s: %w", includePath, name, err)
+			}
+
+			logger.With(logFields{"file": includePath}).Debugf("Including compose file %s from %s", includePath, name)
+
+			env, err := loadEnvFromComposeFile(includePath, stdin, opts, chain)
+			if err != nil {
+				return environment, err
+			}
+			environment = append(environment, env...)
+		}
+	}
+
+	return environment, nil
+}
+
+// composeFileName returns the name of a compose file for the logs and errors, stdin is - unless given a name
+func composeFileName(filename, stdinName string) string {
+	if filename == "-" && stdinName != "" {
+		return stdinName
+	}
+
+	return filename
+}
+
+// parseComposeDocuments parses every document of a yaml stream, so concatenated compose files separated by ---
+// are handled independently
+func parseComposeDocuments(yamlFile []byte) ([]composeInfo, error) {
+	var docs []composeInfo
+
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlFile))
+	for {
+		var cfg composeInfo
+		err := decoder.Decode(&cfg)
+		if err == io.EOF {
+			return docs, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, cfg)
+	}
+}
+
+// validateComposeFiles checks that the compose files are valid yaml with a services section
+func validateComposeFiles(filenames []string, stdin io.Reader, stdinName string) error {
+	for _, filename := range filenames {
+		var data []byte
+		var err error
+
+		if filename == "-" {
+			data, err = ioutil.ReadAll(stdin)
+		} else {
+			data, err = ioutil.ReadFile(filename)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := composeFileName(filename, stdinName)
+		if err := validateComposeFile(data); err != nil {
+			return &ComposeParseError{File: name, Err: err}
+		}
+
+		logger.With(logFields{"file": name}).Debugf("Compose file %s is valid", name)
+	}
+
+	return nil
+}
+
+func validateComposeFile(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+
+	for doc := 1; ; doc++ {
+		var content map[string]interface{}
+		err := decoder.Decode(&content)
+		if err == io.EOF {
+			if doc == 1 {
+				return errors.New("the file is empty")
+			}
+			return nil
+		}
+
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("document %d: %s", doc, strings.Join(typeErr.Errors, "; "))
+		}
+
+		if err != nil {
+			return fmt.Errorf("document %d: %w", doc, err)
+		}
+
+		_, hasServices := content["services"]
+		_, hasInclude := content["include"]
+		if !hasServices && !hasInclude {
+			return fmt.Errorf("document %d: missing the top level services section", doc)
+		}
+	}
+}
+
+// withOverrideFile appends the override file to the default compose file when it exists, like docker compose does
+func withOverrideFile(files []string) []string {
+	if _, err := os.Stat(overrideComposeFile); err != nil {
+		return files
+	}
+
+	logger.Debugf("Including %s", overrideComposeFile)
+
+	return append(files, overrideComposeFile)
+}
+
+// checkDefaultComposeFile reports a missing docker-compose.yml when no compose file was given at all
+func checkDefaultComposeFile() error {
+	if _, err := os.Stat(defaultComposeFile); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("cannot read compose file %s: %w", defaultComposeFile, err)
+		}
+
+		dir, _ := os.Getwd()
+		return fmt.Errorf("no compose file found: %s does not exist in %s, give one with --compose-file or the compose_files setting", defaultComposeFile, dir)
+	}
+
+	return nil
+}
+
+// expandComposeFiles replaces the glob patterns in the compose file list with the files they match, sorted by name.
+// Entries without glob metacharacters are kept as given.
+func expandComposeFiles(patterns []string) ([]string, error) {
+	var files []string
+
+	for _, pattern := range patterns {
+		if pattern == "-" || !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compose file pattern %s: %w", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("compose file pattern %s does not match any file", pattern)
+		}
+
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+// composeFilesFromEnv returns the compose files listed in the named environment variable, separated by commas or
+// by the path list separator like in COMPOSE_FILE
+func composeFilesFromEnv(name string) ([]string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	var files []string
+	for _, file := range splitComposeList(value) {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("environment variable %s doesn't list any compose file", name)
+	}
+
+	return files, nil
+}
+
+// splitComposeList splits a list of compose files on the commas and the path list separators. An URL like
+// https://host:8443/stack.yml has colons of its own, it only ends at the next comma.
+func splitComposeList(value string) []string {
+	var files []string
+
+	start := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] != ',' && rune(value[i]) != os.PathListSeparator {
+			continue
+		}
+		if value[i] != ',' && isRemoteComposeFile(strings.TrimSpace(value[start:])) {
+			continue
+		}
+
+		files = append(files, value[start:i])
+		start = i + 1
+	}
+
+	return append(files, value[start:])
+}
+
+// checkComposeFiles makes sure every compose file can be read before doing any work, stdin is not checked
+func checkComposeFiles(filenames []string) error {
+	for _, filename := range filenames {
+		if filename == "-" {
+			continue
+		}
+
+		file, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("compose file %s does not exist", filename)
+			}
+			return fmt.Errorf("cannot read compose file %s: %w", filename, err)
+		}
+
+		info, err := file.Stat()
+		_ = file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read compose file %s: %w", filename, err)
+		}
+
+		if info.IsDir() {
+			return fmt.Errorf("compose file %s is a directory", filename)
+		}
+	}
+
+	return nil
+}
+
+// labelEnvPrefix is prepended to the normalized key of every --label to name its variable
+const labelEnvPrefix = "DEPLOY_LABEL_"
+
+// labelEnv converts the key=value labels to environment variables, keys are uppercased and any character not valid
+// in a variable name is replaced with an underscore
+func labelEnv(labels []string) ([]string, error) {
+	env := make([]string, 0, len(labels))
+	seen := make(map[string]string, len(labels))
+
+	for _, label := range labels {
+		key, value, found := strings.Cut(label, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", label)
+		}
+
+		name := labelEnvPrefix + invalidEnvChars.ReplaceAllString(strings.ToUpper(key), "_")
+		if previous, ok := seen[name]; ok {
+			return nil, fmt.Errorf("duplicate label %q, already set by %q", key, previous)
+		}
+		seen[name] = key
+
+		env = append(env, name+"="+value)
+	}
+
+	return env, nil
+}
+
+// imageTagEnv is the variable set by --image-tag, the ones of --image add the normalized service name to it
+const imageTagEnv = "IMAGE_TAG"
+
+// validImageTag matches the tags accepted by docker
+var validImageTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// imageEnv converts the --image-tag and the service=tag --image values to the variables used in the image references
+// of the compose files, like image: myapp:${IMAGE_TAG_WEB}
+func imageEnv(tag string, images []string) ([]string, error) {
+	var env []string
+
+	if tag != "" {
+		if !validImageTag.MatchString(tag) {
+			return nil, fmt.Errorf("invalid image tag %q", tag)
+		}
+		env = append(env, imageTagEnv+"="+tag)
+	}
+
+	seen := make(map[string]string, len(images))
+	for _, image := range images {
+		service, serviceTag, found := strings.Cut(image, "=")
+		if !found || service == "" {
+			return nil, fmt.Errorf("invalid image %q, expected service=tag", image)
+		}
+
+		if !validImageTag.MatchString(serviceTag) {
+			return nil, fmt.Errorf("invalid image tag %q for the service %s", serviceTag, service)
+		}
+
+		name := imageTagEnv + "_" + invalidEnvChars.ReplaceAllString(strings.ToUpper(service), "_")
+		if previous, ok := seen[name]; ok {
+			return nil, fmt.Errorf("duplicate image tag for the service %q, already set by %q", service, previous)
+		}
+		seen[name] = service
+
+		env = append(env, name+"="+serviceTag)
+	}
+
+	return env, nil
+}
+
+func loadEnvFiles(filenames []string) ([]string, error) {
+	var envs []string
+
+	for _, filename := range filenames {
+		env, err := loadEnvFile(filename)
+		if err != nil {
+			return envs, err
+		}
+		envs = append(envs, env...)
+	}
+
+	return envs, nil
+}
+
+// loadEnvFile reads KEY=VALUE lines from a file, ignoring blank lines and comments starting with #
+func loadEnvFile(filename string) ([]string, error) {
+	var env []string
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("%s:%d: invalid line, expected KEY=VALUE", filename, i+1)
+		}
+
+		env = append(env, key+"="+strings.TrimSpace(value))
+	}
+
+	return env, nil
+}
+
+// loadAppConfig reads the first config file with one of the given names found from the current directory up to the
+// root, the names are tried in order in each directory. An absolute filename is read directly. When required is set
+// a config that cannot be found is an error instead of an empty config. With merge the first config of every
+// directory is read instead, the ones closer to the current directory taking precedence.
+func loadAppConfig(filenames []string, required, merge bool) (*appConfig, error) {
+	cfg := &appConfig{}
+
+	if len(filenames) == 1 && filepath.IsAbs(filenames[0]) {
+		data, err := ioutil.ReadFile(filenames[0])
+		if err != nil {
+			if os.IsNotExist(err) && !required {
+				return cfg, nil
+			}
+			return nil, err
+		}
+
+		logger.With(logFields{"file": filenames[0]}).Debugf("Reading config file: %s", filenames[0])
+		if err := unmarshalAppConfig(filenames[0], data, cfg); err != nil {
+			return nil, err
+		}
+
+		return cfg, nil
+	}
+
+	targetPath, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	rootDir := filepath.Join(filepath.VolumeName(targetPath), "/")
+	var searched []string
+	// found holds the configs read with merge, from the current directory up
+	var found []*appConfig
+
+	for {
+		searched = append(searched, targetPath)
+
+		for _, filename := range filenames {
+			configPath := filepath.Join(targetPath, filename)
+			data, err := ioutil.ReadFile(configPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+
+			logger.With(logFields{"file": configPath}).Debugf("Reading config file: %s", configPath)
+			dirConfig := &appConfig{}
+			if err := unmarshalAppConfig(configPath, data, dirConfig); err != nil {
+				return nil, err
+			}
+
+			if !merge {
+				return dirConfig, nil
+			}
+
+			found = append(found, dirConfig)
+			break
+		}
+
+		if targetPath == rootDir {
+			break
+		}
+		targetPath = filepath.Dir(targetPath)
+	}
+
+	if len(found) > 0 {
+		for i := len(found) - 1; i >= 0; i-- {
+			cfg.merge(found[i])
+		}
+
+		return cfg, nil
+	}
+
+	if required {
+		return nil, &ConfigNotFoundError{Names: filenames, Dirs: searched}
+	}
+
+	// the settings like the host silently missing are confusing, the directories are only listed in the verbose output
+	names := strings.Join(filenames, ", ")
+	logger.With(logFields{"file": names, "dirs": searched}).Infof("No config file %s found, using the defaults", names)
+	logger.Debugf("Searched for the config file in: %s", strings.Join(searched, ", "))
+
+	return cfg, nil
+}
+
+// unmarshalAppConfig decodes the config in the format given by the file extension, yaml unless it is .json or .toml
+func unmarshalAppConfig(filename string, data []byte, cfg *appConfig) error {
+	var err error
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		err = yaml.Unmarshal(data, cfg)
+	}
+
+	if err != nil {
+		trace.Printf("Cannot parse config file %s: %s", filename, err)
+		return &ConfigParseError{File: filename, Err: err}
+	}
+	trace.Printf("Parsed config file %s: %d bytes", filename, len(data))
+
+	return nil
+}
+
+const (
+	modeStack   = "stack"
+	modeCompose = "compose"
+)
+
+// deploySettings are the resolved options used to build the docker command line
+type deploySettings struct {
+	Host         string
+	Context      string
+	ComposeFiles []string
+	StackName    string
+	// ExtraArgs are the positional arguments after the stack name, passed as is
+	ExtraArgs []string
+	// DockerArgs are added after the options of the deploy command, before the stack name in stack mode
+	DockerArgs   []string
+	RegistryAuth bool
+	Prune        bool
+	// Detach is nil when not given so docker keeps its own default
+	Detach       *bool
+	ResolveImage string
+	// Orchestrator is empty when not given so the swarm default of docker is kept
+	Orchestrator string
+}
+
+// validateMode checks the deploy mode and the flags that only make sense in one of them
+func validateMode(mode string, s deploySettings) error {
+	switch mode {
+	case modeStack:
+		return nil
+	case modeCompose:
+		if s.ResolveImage != "" {
+			return errors.New("--resolve-image is only supported in stack mode")
+		}
+		if s.Orchestrator != "" {
+			return errors.New("--orchestrator is only supported in stack mode")
+		}
+		if s.RegistryAuth {
+			logger.Warnf("--with-registry-auth has no effect in compose mode, the local credentials are always used")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid mode %q, valid values are: stack, compose", mode)
+	}
+}
+
+// resolveDaemon returns the docker hosts or context to use. When any of them is given in the command line the config
+// file is ignored, and only one of them can be set.
+func resolveDaemon(flagHosts []string, flagContext string, cfg *appConfig) ([]string, string, error) {
+	var hosts []string
+	if cfg.Host != "" {
+		hosts = []string{cfg.Host}
+	}
+	context := cfg.Context
+
+	if len(flagHosts) > 0 || flagContext != "" {
+		hosts, context = flagHosts, flagContext
+	}
+
+	if len(hosts) > 0 && context != "" {
+		return nil, "", fmt.Errorf("cannot use both the docker host %s and the context %s, choose one of them", strings.Join(hosts, ", "), context)
+	}
+
+	seen := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if seen[host] {
+			return nil, "", fmt.Errorf("the docker host %s is given twice", host)
+		}
+		seen[host] = true
+
+		if err := validateDockerHost(host); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return hosts, context, nil
+}
+
+// validateDockerHost checks the ssh:// hosts before running docker, as a malformed one only fails once docker tries
+// to connect
+func validateDockerHost(host string) error {
+	if !strings.HasPrefix(host, "ssh://") {
+		return nil
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid docker host %s: %w", host, err)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid docker host %s: missing the host name, use ssh://[user@]host[:port]", host)
+	}
+
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid docker host %s: unexpected path or query, use ssh://[user@]host[:port]", host)
+	}
+
+	return nil
+}
+
+// daemonArgs returns the global docker arguments that select the daemon
+func daemonArgs(s deploySettings) []string {
+	if s.Host != "" {
+		return []string{"--host", s.Host}
+	}
+
+	if s.Context != "" {
+		return []string{"--context", s.Context}
+	}
+
+	return nil
+}
+
+// stackArgs builds the arguments of a docker stack deploy command
+func stackArgs(s deploySettings) []string {
+	args := daemonArgs(s)
+
+	args = append(args, "stack", "deploy")
+	for _, composeFile := range s.ComposeFiles {
+		args = append(args, "--compose-file", composeFile)
+	}
+
+	if s.RegistryAuth {
+		args = append(args, "--with-registry-auth")
+	}
+
+	if s.Prune {
+		args = append(args, "--prune")
+	}
+
+	if s.Detach != nil {
+		args = append(args, fmt.Sprintf("--detach=%t", *s.Detach))
+	}
+
+	if s.ResolveImage != "" {
+		args = append(args, "--resolve-image", s.ResolveImage)
+	}
+
+	if s.Orchestrator != "" {
+		args = append(args, "--orchestrator", s.Orchestrator)
+	}
+
+	args = append(args, s.DockerArgs...)
+	args = append(args, s.StackName)
+
+	return append(args, s.ExtraArgs...)
+}
+
+// composeArgs builds the arguments of a docker compose up command, using the stack name as project name.
+// The extra arguments are passed after up, so they can be used to select the services to start.
+func composeArgs(s deploySettings) []string {
+	args := daemonArgs(s)
+
+	args = append(args, "compose")
+	for _, composeFile := range s.ComposeFiles {
+		args = append(args, "--file", composeFile)
+	}
+
+	args = append(args, "--project-name", s.StackName, "up")
+
+	if s.Detach == nil || *s.Detach {
+		args = append(args, "--detach")
+	}
+
+	// the compose equivalent of pruning services that are no longer in the compose file
+	if s.Prune {
+		args = append(args, "--remove-orphans")
+	}
+
+	args = append(args, s.DockerArgs...)
+
+	return append(args, s.ExtraArgs...)
+}
+
+const (
+	stackNameFromArgs      = "the command line"
+	stackNameFromConfig    = "the config file"
+	stackNameFromDirectory = "the current directory name"
+	stackNameFromManifest  = "the manifest"
+)
+
+// resolveStackName returns the stack name and where it came from, looking at the command line arguments,
+// then the config file and finally, when fallback is set, the name of the current directory
+func resolveStackName(positional []string, cfg *appConfig, fallback bool) (string, string, error) {
+	if len(positional) > 0 {
+		return positional[0], stackNameFromArgs, nil
+	}
+
+	if cfg.StackName != "" {
+		return cfg.StackName, stackNameFromConfig, nil
+	}
+
+	if !fallback {
+		return "", "", errors.New("no stack name provided in the command line or the config file")
+	}
+
+	dirname, err := os.Getwd()
+	if err != nil {
+		return "", "", fmt.Errorf("no stack name provided in the command line or the config file and cannot read the current directory: %w", err)
+	}
+
+	return filepath.Base(dirname), stackNameFromDirectory, nil
+}
+
+var validStackName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// decorateStackName adds the --name-prefix and --name-suffix to a resolved stack name and checks the result can be
+// used by docker
+func decorateStackName(name, prefix, suffix string) (string, error) {
+	decorated := prefix + name + suffix
+	if !validStackName.MatchString(decorated) {
+		return "", fmt.Errorf("invalid stack name %q, use letters, digits, dashes, underscores and dots", decorated)
+	}
+
+	return decorated, nil
+}
+
+// changeDir changes the current directory and returns a function that goes back to the previous one
+func changeDir(dir string) (func(), error) {
+	previous, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		return nil, fmt.Errorf("cannot change to the working directory: %w", err)
+	}
+
+	logger.Debugf("Changed the working directory to %s", dir)
+
+	return func() { _ = os.Chdir(previous) }, nil
+}
+
+// resolveDockerBinary returns the docker executable to run, the flag takes precedence over the config file.
+// An explicitly configured binary is checked up front so a wrong path is reported before doing any work.
+func resolveDockerBinary(flagValue, configValue string) (string, error) {
+	binary := flagValue
+	if binary == "" {
+		binary = configValue
+	}
+
+	if binary == "" {
+		return "docker", nil
+	}
+
+	if _, err := exec.LookPath(binary); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", fmt.Errorf("docker binary %s not found, check the --docker-bin or docker_binary setting: %w", binary, err)
+		}
+		return "", fmt.Errorf("cannot use docker binary %s: %w", binary, err)
+	}
+
+	return binary, nil
+}
+
+// shellQuote quotes a string so it can be pasted as a single word in a POSIX shell
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\$`!*?[]{}()<>|&;#~") {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellCommand renders a command with its extra environment as a copy-pasteable shell snippet
+func shellCommand(env []string, name string, args []string) string {
+	var sb strings.Builder
+
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		sb.WriteString(key + "=" + shellQuote(value) + " \\\n")
+	}
+
+	sb.WriteString(shellQuote(name))
+	for _, arg := range args {
+		sb.WriteString(" " + shellQuote(arg))
+	}
+
+	return sb.String()
+}
+
+// commandRunner runs an external command. It returns the exit code of a command that ran and failed with a nil
+// error, and an error when the command couldn't run or was stopped by docker-deploy.
+type commandRunner interface {
+	Run(name string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) (exitCode int, err error)
+}
+
+var (
+	// errTimedOut is returned when the command was killed after the timeout
+	errTimedOut = errors.New("the command did not finish in time and was killed")
+	// errInterrupted is returned along with the exit code of a command that a signal was forwarded to
+	errInterrupted = errors.New("the command was interrupted")
+)
+
+// runnerOptions are the settings given by the flags to the runners of run
+type runnerOptions struct {
+	// Timeout kills the commands that don't finish in time, they have no limit when 0
+	Timeout time.Duration
+	// Inherit lists the variables of the environment of docker-deploy given to the commands, all of them when nil
+	Inherit []string
+}
+
+// execRunner runs the commands with os/exec, killing them after Timeout when not zero. The given env is added to
+// the environment of docker-deploy.
+type execRunner struct {
+	Timeout time.Duration
+	// Inherit lists the variables of the environment of docker-deploy given to the commands, all of them when nil
+	Inherit []string
+}
+
+func newExecRunner(opts runnerOptions) commandRunner {
+	return &execRunner{Timeout: opts.Timeout, Inherit: opts.Inherit}
+}
+
+// essentialEnv are the variables inherited with --inherit-env unless excluded, needed by docker to find its helpers
+// and its config
+var essentialEnv = []string{"PATH", "HOME", "USERPROFILE", "SystemRoot"}
+
+// minimalEnv are the variables still inherited with --clean-env, without them no program starts on Windows
+var minimalEnv = []string{"SystemRoot"}
+
+// inheritedEnvNames returns the variables to inherit for the --inherit-env values: the essential ones, or only the
+// minimal ones for a clean environment, the ones listed and not the ones excluded with a leading -
+func inheritedEnvNames(values []string, clean bool) ([]string, error) {
+	excluded := make(map[string]bool)
+	var listed []string
+
+	for _, value := range values {
+		name := strings.TrimPrefix(value, "-")
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return nil, fmt.Errorf("invalid variable name %q", value)
+		}
+
+		if strings.HasPrefix(value, "-") {
+			excluded[name] = true
+		} else {
+			listed = append(listed, name)
+		}
+	}
+
+	base := essentialEnv
+	if clean {
+		base = minimalEnv
+	}
+
+	names := make([]string, 0, len(base)+len(listed))
+	for _, name := range append(append([]string{}, base...), listed...) {
+		if !excluded[name] {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// filterEnv keeps the KEY=VALUE entries of the given names, ignoring their case on Windows where PATH is usually Path
+func filterEnv(env []string, names []string) []string {
+	foldCase := runtime.GOOS == "windows"
+
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		if foldCase {
+			name = strings.ToUpper(name)
+		}
+		keep[name] = true
+	}
+
+	filtered := make([]string, 0, len(names))
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		if foldCase {
+			key = strings.ToUpper(key)
+		}
+		if keep[key] {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+func (r *execRunner) Run(name string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	if r.Inherit != nil {
+		cmd.Env = append(filterEnv(os.Environ(), r.Inherit), env...)
+	} else if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	interrupted, err := runCommand(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		return exitTimeout, errTimedOut
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if interrupted {
+			return exitCode(exitErr), errInterrupted
+		}
+		return exitCode(exitErr), nil
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return 0, nil
+}
+
+// retryablePatterns match the docker errors caused by a temporarily unreachable manager
+var retryablePatterns = regexp.MustCompile(`(?i)connection refused|connection reset|no route to host|i/o timeout|timed out|timeout`)
+
+// retryableReason returns why a failed docker run can be retried, or an empty string if it cannot
+func retryableReason(err error, errOutput string) string {
+	if errors.Is(err, errTimedOut) {
+		return "timeout"
+	}
+
+	// docker couldn't be started
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(retryablePatterns.FindString(errOutput))
+}
+
+// hookShell returns the system shell and its arguments to run the given command line
+func hookShell(command string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", []string{"/C", command}
+	}
+
+	return "sh", []string{"-c", command}
+}
+
+// runHook runs a user command with the shell, passing it the environment of the deploy. The hooks inherit the same
+// variables as docker but have no timeout.
+func (d *deployer) runHook(name, command string, env []string) error {
+	logger.With(logFields{"command": []string{command}}).Infof("Running %s hook: %s", name, command)
+
+	shell, args := hookShell(command)
+	code, err := d.hookRunner.Run(shell, args, env, d.stdin, d.stdout, d.stderr)
+	if err != nil {
+		return fmt.Errorf("the %s hook failed: %w", name, err)
+	}
+	if code != 0 {
+		return fmt.Errorf("the %s hook failed with exit code %d", name, code)
+	}
+
+	return nil
+}
+
+// signalGracePeriod is how long docker has to exit after a forwarded signal before being killed
+const signalGracePeriod = 10 * time.Second
+
+// runCommand starts the command and waits for it, forwarding SIGINT and SIGTERM so a cancelled deploy
+// doesn't leave docker running in the background. It reports whether a signal was forwarded.
+func runCommand(cmd *exec.Cmd) (bool, error) {
+	if trace.enabled() {
+		trace.Printf("Running %s with the arguments %q", cmd.Path, cmd.Args[1:])
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		trace.Env("Environment of the command", env)
+	}
+
+	if err := cmd.Start(); err != nil {
+		trace.Printf("Cannot start %s: %s", cmd.Path, err)
+		return false, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var kill <-chan time.Time
+	for {
+		select {
+		case err := <-done:
+			return kill != nil, err
+		case sig := <-signals:
+			logger.Warnf("Received %s, forwarding it to docker", sig)
+			if err := cmd.Process.Signal(sig); err != nil {
+				_ = cmd.Process.Kill()
+			}
+			if kill == nil {
+				kill = time.After(signalGracePeriod)
+			}
+		case <-kill:
+			logger.Warnf("Docker did not exit %s after the signal, killing it", signalGracePeriod)
+			_ = cmd.Process.Kill()
+		}
+	}
+}
+
+// exitCode returns the exit code of a finished process, using the shell convention of 128 + signal number
+// when it was terminated by a signal
+func exitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return err.ExitCode()
+}
+
+func loadVersionInfo() {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				Revision = setting.Value
+			case "vcs.time":
+				LastCommit, _ = time.Parse(time.RFC3339, setting.Value)
+			case "vcs.modified":
+				Modified = setting.Value == "true"
+			}
+		}
+	}
+}
+
+// defaultMaskPattern matches the variable names that usually hold credentials
+const defaultMaskPattern = `(?i)(pass|secret|token|key|credential|auth)`
+
+// maskEnv returns a copy of the entries with the values of the variables whose name matches the mask hidden
+func maskEnv(env []string, mask *regexp.Regexp) []string {
+	masked := make([]string, len(env))
+
+	for i, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		if mask != nil && mask.MatchString(key) {
+			entry = key + "=****"
+		}
+		masked[i] = entry
+	}
+
+	return masked
+}
+
+// outputPrefixData is the data available to the --output-prefix template
+type outputPrefixData struct {
+	Stack string
+}
+
+// stackDeploy is a stack deployed by a run with its own compose files
+type stackDeploy struct {
+	Name string
+	// Source is where the name came from, it is logged before deploying
+	Source       string
+	ComposeFiles []string
+	// ExtraArgs are the positional arguments after the stack name
+	ExtraArgs []string
+	// Host is the docker host the stack is deployed to, the context or the default daemon is used when empty
+	Host string
+}
+
+// hookEnv returns the environment of the hooks, the given variables plus the stack name and its compose files
+// separated by commas, the colons of COMPOSE_FILE would be ambiguous with the URLs
+func (s stackDeploy) hookEnv(env []string) []string {
+	hookEnv := append([]string{}, env...)
+
+	return append(hookEnv,
+		"DEPLOY_STACK_NAME="+s.Name,
+		"DEPLOY_COMPOSE_FILES="+strings.Join(s.ComposeFiles, ","),
+	)
+}
+
+// deployer holds what is shared by all the stacks deployed by a run
+type deployer struct {
+	opts   *options
+	runner commandRunner
+	// hookRunner runs the pre and post deploy hooks, without the timeout of docker
+	hookRunner commandRunner
+	stdin      io.Reader
+	stdout     io.Writer
+	stderr     io.Writer
+	binary     string
+	context    string
+	fileEnv    []string
+	envOpts    envOptions
+	printEnv   bool
+	// forceEnv is the KEY=VALUE entry added by --force, empty otherwise
+	forceEnv string
+	// outputPrefix renders the prefix of the docker output lines from an outputPrefixData, nothing is added when nil
+	outputPrefix *template.Template
+	// mask matches the names of the variables whose values are hidden in the logs, nothing is hidden when nil
+	mask *regexp.Regexp
+	// maskDryRun hides the masked values in the dry run command too, only when --mask-pattern is given
+	maskDryRun bool
+	// summary collects the result of every deploy for the --summary-file
+	summary *runSummary
+	// envFD receives the generated variables of every stack for --env-fd, nil otherwise
+	envFD io.Writer
+	// envFDStacks are the stacks whose variables were already written to envFD, they are the same on every host
+	envFDStacks map[string]bool
+	// production asks for a confirmation before each deploy unless --yes is given
+	production bool
+	// stdinCompose is the compose file given on stdin, read once so every target and docker run gets the same bytes.
+	// It is nil when no compose file is read from stdin, then docker inherits stdin untouched.
+	stdinCompose []byte
+}
+
+// readsStdin reports whether any of the stacks reads a compose file from stdin
+func readsStdin(stacks []stackDeploy) bool {
+	for _, stack := range stacks {
+		for _, file := range stack.ComposeFiles {
+			if file == "-" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// composeStdin returns the stdin of the compose readers and of docker, a new reader over the compose file read from
+// stdin for each of them
+func (d *deployer) composeStdin() io.Reader {
+	if d.stdinCompose != nil {
+		return bytes.NewReader(d.stdinCompose)
+	}
+
+	return d.stdin
+}
+
+// daemonName describes the daemon the stack is deployed to for the log messages
+func (d *deployer) daemonName(stack stackDeploy) string {
+	switch {
+	case stack.Host != "":
+		return "the docker daemon at " + stack.Host
+	case d.context != "":
+		return "the docker daemon of the context " + d.context
+	default:
+		return "the local docker daemon"
+	}
+}
+
+// deploy deploys the stack, recording the result for the --summary-file and the --metrics-file
+func (d *deployer) deploy(stack stackDeploy) (int, error) {
+	summary := deploySummary{Stack: stack.Name, Host: stack.Host, Context: d.context, ComposeFiles: stack.ComposeFiles}
+	summary.DryRun = *d.opts.dryRun || *d.opts.pruneDryRun
+
+	started := time.Now()
+	code, err := d.deployStack(stack, &summary)
+	summary.finished = time.Now()
+	summary.elapsed = summary.finished.Sub(started)
+
+	summary.ExitCode = code
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	d.summary.Deploys = append(d.summary.Deploys, summary)
+
+	return code, err
+}
+
+// deployStack generates the environment of the stack from its compose files and runs docker. It returns a non zero
+// exit code when the deploy fails, along with the error unless it was already reported.
+func (d *deployer) deployStack(stack stackDeploy, summary *deploySummary) (int, error) {
+	var env []string
+	var err error
+
+	// checked before anything else, an invalid file shouldn't run the hooks nor ask for a confirmation
+	if *d.opts.validate {
+		if err := validateComposeFiles(stack.ComposeFiles, d.composeStdin(), d.envOpts.StdinName); err != nil {
+			return exitCompose, fmt.Errorf("local compose files: %w", err)
+		}
+	}
+
+	if *d.opts.pruneDryRun {
+		return d.reportPrunable(stack)
+	}
+
+	// asked before anything is run, the pre-deploy hook included
+	if d.production && !d.printEnv && !*d.opts.dryRun && !*d.opts.yes {
+		if err := d.confirmDeploy(stack); err != nil {
+			return exitUsage, err
+		}
+	}
+
+	if *d.opts.preDeploy != "" && !d.printEnv {
+		if *d.opts.dryRun {
+			logger.Infof("Dry run, the pre-deploy hook would be executed: %s", *d.opts.preDeploy)
+		} else if err := d.runHook("pre-deploy", *d.opts.preDeploy, stack.hookEnv(d.fileEnv)); err != nil {
+			return exitHook, err
+		}
+	}
+
+	if !*d.opts.noHash {
+		env, err = loadEnvFromConfigFiles(stack.ComposeFiles, d.composeStdin(), d.envOpts)
+		if err != nil {
+			// the files are always hashed on this machine, even when the daemon is remote
+			return exitCompose, fmt.Errorf("local compose files: %w", err)
+		}
+
+		if len(env) == 0 && *d.opts.requireHashes {
+			return exitCompose, fmt.Errorf("no config or secret file was hashed for stack %s, see --require-hashes", stack.Name)
+		}
+
+		if cache := d.envOpts.Hash.Cache; cache != nil {
+			if err := cache.save(); err != nil {
+				logger.Warnf("Cannot write the hash cache %s: %s", *d.opts.hashCachePath, err.Error())
+			}
+		}
+
+		if annotations := d.envOpts.Annotations; annotations != nil {
+			if *d.opts.dryRun {
+				logger.Infof("Dry run, the compose files would be annotated with the %s label", annotationLabel)
+			} else if err := annotations.write(); err != nil {
+				return exitCompose, err
+			}
+		}
+	}
+
+	// the variables of each manifest stack are labelled with its name
+	label := ""
+	if stack.Source == stackNameFromManifest {
+		label = stack.Name
+	}
+
+	// written before deploying so the caller gets them even when docker fails
+	if d.envFD != nil && !d.envFDStacks[stack.Name] {
+		if err := writeEnv(d.envFD, env, envOutputDotenv, label); err != nil {
+			return exitError, fmt.Errorf("cannot write the variables to --env-fd %d: %w", *d.opts.envFD, err)
+		}
+		d.envFDStacks[stack.Name] = true
+	}
+
+	if d.printEnv {
+		if err := writeEnv(d.stdout, env, *d.opts.envOutput, label); err != nil {
+			return exitError, err
+		}
+		return 0, nil
+	}
+
+	generated := env
+	summary.setEnv(generated)
+
+	if *d.opts.lockfile != "" {
+		if *d.opts.updateLock && *d.opts.dryRun {
+			logger.Infof("Dry run, the lockfile %s would be updated", *d.opts.lockfile)
+		} else if *d.opts.updateLock {
+			if err := writeLockfile(*d.opts.lockfile, generated); err != nil {
+				return exitConfig, fmt.Errorf("cannot write the lockfile %s: %w", *d.opts.lockfile, err)
+			}
+			logger.Infof("Updated the lockfile %s", *d.opts.lockfile)
+		} else if err := checkLockfile(*d.opts.lockfile, generated); err != nil {
+			var mismatch *lockMismatchError
+			if errors.As(err, &mismatch) {
+				return exitLock, err
+			}
+			return exitConfig, err
+		}
+	}
+
+	// later entries take precedence, so the computed hashes win over the env files
+	env = append(append([]string{}, d.fileEnv...), env...)
+
+	if d.forceEnv != "" {
+		logger.Infof("Forcing the redeploy with %s", d.forceEnv)
+		env = append(env, d.forceEnv)
+	}
+
+	trace.Env("Resolved variables of stack "+stack.Name, env)
+
+	if len(env) > 0 {
+		masked := maskEnv(env, d.mask)
+		logger.With(logFields{"env": masked}).Debugf("Variables added to the docker environment:\n%s", strings.Join(masked, "\n"))
+	}
+
+	if stack.Source == stackNameFromArgs {
+		logger.Debugf("Using stack name %s from %s", stack.Name, stack.Source)
+	} else {
+		logger.Infof("Using stack name %s from %s", stack.Name, stack.Source)
+	}
+
+	settings := deploySettings{
+		Host:         stack.Host,
+		Context:      d.context,
+		ComposeFiles: stack.ComposeFiles,
+		StackName:    stack.Name,
+		ExtraArgs:    stack.ExtraArgs,
+		DockerArgs:   *d.opts.dockerArgs,
+		RegistryAuth: *d.opts.auth,
+		Prune:        *d.opts.prune,
+		ResolveImage: *d.opts.resolveImage,
+		Orchestrator: *d.opts.orchestrator,
+	}
+
+	// only forward the flag when given so docker keeps its own default otherwise
+	if d.opts.flags.Changed("detach") {
+		settings.Detach = d.opts.detach
+	}
+
+	var args []string
+	if *d.opts.mode == modeCompose {
+		args = composeArgs(settings)
+	} else {
+		args = stackArgs(settings)
+	}
+
+	if *d.opts.dryRun {
+		// the command can be copied and run, unless the masking was asked for to paste it in a ticket
+		printed := env
+		if d.maskDryRun {
+			printed = maskEnv(env, d.mask)
+			logger.Infof("Dry run, the values matching --mask-pattern are hidden, the command cannot be run as is")
+		}
+		logger.With(logFields{"env": printed, "command": append([]string{d.binary}, args...)}).
+			Infof("Dry run, the following command would be executed:\n%s", shellCommand(printed, d.binary, args))
+		if *d.opts.postDeploy != "" {
+			logger.Infof("Dry run, the post-deploy hook would be executed: %s", *d.opts.postDeploy)
+		}
+		return 0, nil
+	}
+
+	logger.With(logFields{"command": append([]string{d.binary}, args...)}).
+		Infof("Running: %s %v", d.binary, strings.Join(args, " "))
+
+	var stdout io.Writer = d.stdout
+	stderrOut := d.stderr
+	if d.outputPrefix != nil {
+		var sb strings.Builder
+		if err := d.outputPrefix.Execute(&sb, outputPrefixData{Stack: stack.Name}); err != nil {
+			return exitUsage, fmt.Errorf("cannot render the output prefix: %w", err)
+		}
+		stdout = newPrefixWriter(d.stdout, sb.String())
+		stderrOut = newPrefixWriter(d.stderr, sb.String())
+	}
+
+	var code int
+	delay := *d.opts.retryDelay
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		stdin := d.composeStdin()
+
+		// docker's stderr is only captured when it may be needed to decide whether to retry
+		var errOutput bytes.Buffer
+		stderr := stderrOut
+		if *d.opts.retries > 0 {
+			stderr = io.MultiWriter(stderrOut, &errOutput)
+		}
+
+		code, err = d.runner.Run(d.binary, args, env, stdin, stdout, stderr)
+		if (code == 0 && err == nil) || errors.Is(err, errInterrupted) || attempt > *d.opts.retries {
+			break
+		}
+
+		reason := retryableReason(err, errOutput.String())
+		if reason == "" {
+			break
+		}
+
+		logger.Warnf("Deploy attempt %d of %d failed (%s), retrying in %s", attempt, *d.opts.retries+1, reason, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	summary.setDuration(time.Since(started))
+
+	if errors.Is(err, errTimedOut) {
+		logger.Errorf("The docker command did not finish after %s and was killed", *d.opts.timeout)
+		return exitTimeout, nil
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return exitNotFound, fmt.Errorf("docker binary %s not found, install docker or set its path with --docker-bin", d.binary)
+	}
+
+	if err != nil && !errors.Is(err, errInterrupted) {
+		return exitDocker, fmt.Errorf("cannot run the local docker binary %s: %w", d.binary, err)
+	}
+
+	// docker already reported its own failure, only tell where it happened
+	if code != 0 {
+		return code, &DockerExecError{Daemon: d.daemonName(stack), Code: code}
+	}
+
+	// the state is only recorded once docker applied it
+	if *d.opts.stateFile != "" && !*d.opts.noHash {
+		if err := newDeployState(generated).save(*d.opts.stateFile); err != nil {
+			logger.Warnf("Cannot write the state file %s: %s", *d.opts.stateFile, err.Error())
+		}
+	}
+
+	if *d.opts.postDeploy != "" {
+		if err := d.runHook("post-deploy", *d.opts.postDeploy, stack.hookEnv(env)); err != nil {
+			return exitHook, err
+		}
+	}
+
+	return 0, nil
+}
+
+// versionInfo is the json form of the version, the commit date is null when unknown
+type versionInfo struct {
+	Tag        string     `json:"tag"`
+	Revision   string     `json:"revision"`
+	LastCommit *time.Time `json:"last_commit"`
+	Modified   bool       `json:"modified"`
+}
+
+// printVersion writes the version info in the given format, text or json
+func printVersion(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := fmt.Fprintf(w, "docker-deploy version: %s, commit: %s, date: %s, clean build: %t\n", Tag, Revision, LastCommit, !Modified)
+		return err
+	case "json":
+		info := versionInfo{Tag: Tag, Revision: Revision, Modified: Modified}
+		if !LastCommit.IsZero() {
+			info.LastCommit = &LastCommit
+		}
+
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	default:
+		return fmt.Errorf("invalid version format %q, valid values are: text, json", format)
+	}
+}
+
+// options are the command line flags of a run
+type options struct {
+	flags *flag.FlagSet
+
+	noOverride          *bool
+	workingDir          *string
+	configFile          *string
+	mergeConfigs        *bool
+	strictName          *bool
+	namePrefix          *string
+	nameSuffix          *string
+	environment         *string
+	mode                *string
+	auth                *bool
+	prune               *bool
+	pruneDryRun         *bool
+	hosts               *[]string
+	dockerContext       *string
+	dockerConfigContext *bool
+	composeFiles        *[]string
+	stdinName           *string
+	caCert              *string
+	composeFileFromEnv  *string
+	detach              *bool
+	resolveImage        *string
+	orchestrator        *string
+	inheritEnv          *[]string
+	cleanEnv            *bool
+	envFiles            *[]string
+	dockerArgs          *[]string
+	template            *bool
+	imageTag            *string
+	images              *[]string
+	deployLabels        *[]string
+	validate            *bool
+	noHash              *bool
+	annotate            *bool
+	ignore              *[]string
+	requireHashes       *bool
+	checkPermissions    *bool
+	strictPermissions   *bool
+	strictInterpolation *bool
+	hashAlgo            *string
+	normalizeEOL        *bool
+	hashLength          *int
+	hashSource          *string
+	maxFileSize         *string
+	dryRun              *bool
+	yes                 *bool
+	dockerBin           *string
+	envOutput           *string
+	force               *bool
+	forceEnvName        *string
+	envPrefix           *string
+	envNameTemplate     *string
+	fingerprintEnv      *string
+	failOnCollision     *bool
+	quiet               *bool
+	verbose             *int
+	outputPrefix        *string
+	maskPattern         *string
+	logFile             *string
+	trace               *bool
+	traceFile           *string
+	color               *string
+	logFormat           *string
+	onMissingFile       *string
+	timeout             *time.Duration
+	hashConcurrency     *int
+	hashCachePath       *string
+	retries             *int
+	retryDelay          *time.Duration
+	summaryFile         *string
+	metricsFile         *string
+	envFD               *int
+	stateFile           *string
+	lockfile            *string
+	updateLock          *bool
+	manifestFile        *string
+	failFast            *bool
+	preDeploy           *string
+	postDeploy          *string
+	requireCleanBuild   *bool
+	version             *string
+}
+
+// newOptions declares the flags on a new flag set writing its usage and errors to output
+func newOptions(output io.Writer) *options {
+	fs := flag.NewFlagSet("docker-deploy", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	o := &options{flags: fs}
+	o.noOverride = fs.Bool("no-override", false, "Don't include docker-compose.override.yml when using the default compose file")
+	o.workingDir = fs.StringP("working-dir", "C", "", "Run as if started in the given directory")
+	o.configFile = fs.StringP("config", "f", "", "Name of the config file searched from the current directory up")
+	o.mergeConfigs = fs.Bool("merge-configs", false, "Merge the config files of every parent directory instead of reading the closest one")
+	o.strictName = fs.Bool("strict-name", false, "Fail when no stack name is given instead of using the current directory name")
+	o.namePrefix = fs.String("name-prefix", "", "Prefix added to the resolved stack name")
+	o.nameSuffix = fs.String("name-suffix", "", "Suffix added to the resolved stack name, like -staging")
+	o.environment = fs.String("environment", "", "Use the settings of the named environment of the config file")
+	o.mode = fs.String("mode", modeStack, "Deploy with docker stack deploy or docker compose up (stack, compose)")
+	o.auth = fs.BoolP("with-registry-auth", "a", false, "Send registry authentication details to Swarm agents")
+	o.prune = fs.BoolP("prune", "p", false, "Prune services that are no longer referenced")
+	o.pruneDryRun = fs.Bool("prune-dry-run", false, "List the services that --prune would remove from the running stack, without deploying")
+	o.hosts = fs.StringSliceP("host", "H", nil, "Daemon socket(s) to connect to, the stacks are deployed to each of them in sequence")
+	o.dockerContext = fs.String("context", "", "Name of the docker context to use, cannot be combined with --host")
+	o.dockerConfigContext = fs.Bool("docker-config-context", false, "Use the current context of the docker config.json when no host or context is set")
+	o.composeFiles = fs.StringSliceP("compose-file", "c", []string{defaultComposeFile}, "Path to a Compose file or glob pattern, or '-' to read from stdin")
+	o.stdinName = fs.String("stdin-name", "", "Name of the compose file read from stdin in the logs and errors, relative paths are resolved from its directory")
+	o.caCert = fs.String("ca-cert", "", "Trust the certificates of this PEM file to download the compose files given as https URLs")
+	o.composeFileFromEnv = fs.String("compose-file-from-env", "", "Read the compose files from the named environment variable, separated by commas or colons")
+	o.detach = fs.Bool("detach", true, "Exit immediately instead of waiting for the stack services to converge")
+	o.resolveImage = fs.String("resolve-image", "", "Query the registry to resolve image digest and supported platforms (always, changed, never)")
+	o.orchestrator = fs.String("orchestrator", "", "Orchestrator of the stack (swarm, kubernetes), only forwarded to docker when given")
+	o.inheritEnv = fs.StringSlice("inherit-env", nil, "Only give docker these variables of the environment, plus PATH and HOME unless excluded with -NAME")
+	o.cleanEnv = fs.Bool("clean-env", false, "Don't give docker any variable of the environment, only the generated ones and the --inherit-env ones")
+	o.envFiles = fs.StringArray("env-file", nil, "Read environment variables from a file, can be repeated")
+	o.dockerArgs = fs.StringArray("docker-arg", nil, "Pass an extra argument to the docker deploy command, can be repeated")
+	o.deployLabels = fs.StringArray("label", nil, "Pass key=value as the DEPLOY_LABEL_KEY variable, can be repeated")
+	o.imageTag = fs.String("image-tag", "", "Pass the tag as the IMAGE_TAG variable, for images like myapp:${IMAGE_TAG}")
+	o.images = fs.StringArray("image", nil, "Pass service=tag as the IMAGE_TAG_SERVICE variable, can be repeated")
+	o.template = fs.Bool("template", false, "Render the compose files as Go templates with .Stack, .Env and .Config before using them")
+	o.validate = fs.Bool("validate", false, "Check the compose files are valid yaml with a services section before deploying")
+	o.noHash = fs.Bool("no-hash", false, "Don't generate environment variables from the config and secret files")
+	o.annotate = fs.Bool("annotate", false, "Record the generated variable of each config and secret in a label of the compose files, keeping a .orig backup")
+	o.ignore = fs.StringArray("ignore", nil, "Don't generate a variable for the configs and secrets matching a glob pattern, can be repeated")
+	o.requireHashes = fs.Bool("require-hashes", false, "Fail when the compose files don't generate any variable")
+	o.checkPermissions = fs.Bool("check-permissions", false, "Warn about the secret files that can be accessed by other users than the owner")
+	o.strictPermissions = fs.Bool("strict-permissions", false, "Fail instead of warning about the secret files accessible by other users")
+	o.strictInterpolation = fs.Bool("strict-interpolation", false, "Fail when a config or secret path uses a variable that is not set")
+	o.hashAlgo = fs.String("hash-algo", "sha256", "Hash algorithm used to version config and secret files (sha256, sha512, md5, blake2b)")
+	o.normalizeEOL = fs.Bool("normalize-eol", false, "Replace CRLF line endings with LF before hashing the files")
+	o.maxFileSize = fs.String("max-file-size", defaultMaxFileSize, "Size of the largest config or secret file that can be hashed, like 512K, 100M or 1G, 0 for no limit")
+	o.hashSource = fs.String("hash-source", hashSourceContent, "How the config and secret files are versioned (content, git-blob)")
+	o.hashLength = fs.Int("hash-length", 8, "Number of digest bytes used to version config and secret files (1-32)")
+	o.force = fs.Bool("force", false, "Add a variable with a new value on every run so the services using it are always updated")
+	o.forceEnvName = fs.String("force-env-name", "DEPLOY_FORCE", "Name of the variable added by --force")
+	o.dryRun = fs.BoolP("dry-run", "n", false, "Print the docker command and environment without executing it")
+	o.yes = fs.BoolP("yes", "y", false, "Deploy to the production daemons without asking for a confirmation")
+	o.dockerBin = fs.String("docker-bin", "", "Path or name of the docker executable (default \"docker\")")
+	o.envOutput = fs.String("env-output", envOutputDotenv, "Format of the variables printed by the env subcommand (dotenv, yaml, json)")
+	o.envPrefix = fs.String("env-prefix", "", "Prefix added to the generated environment variable names")
+	o.envNameTemplate = fs.String("env-name-template", defaultEnvNameTemplate, "Go template used to name the environment variables, with .Name, .File and .Base available")
+	o.fingerprintEnv = fs.String("fingerprint-env", "", "Add a variable with the hash of all the generated ones, e.g. DEPLOY_FINGERPRINT")
+	o.failOnCollision = fs.Bool("fail-on-collision", false, "Fail when two files generate the same environment variable with different values")
+	o.quiet = fs.BoolP("quiet", "q", false, "Only show warnings and errors, the docker output is not affected")
+	o.verbose = fs.CountP("verbose", "V", "Show additional information like the config file in use and the generated variables")
+	o.outputPrefix = fs.String("output-prefix", "", "Go template prefixed to every line of the docker output, with .Stack available")
+	o.maskPattern = fs.String("mask-pattern", defaultMaskPattern, "Regular expression of the variable names whose values are hidden in the verbose output")
+	o.logFile = fs.String("log-file", "", "Append the docker-deploy log lines to a file too")
+	o.trace = fs.Bool("trace", false, "Log every file opened, yaml parsed and command run with its environment, for bug reports")
+	o.traceFile = fs.String("trace-file", "", "Write the --trace lines to this file instead of stderr")
+	o.color = fs.String("color", "auto", "Color the log lines by level (auto, always, never)")
+	o.logFormat = fs.String("log-format", "text", "Format of the log output (text, json)")
+	o.onMissingFile = fs.String("on-missing-file", missingFileWarn, "What to do when a config or secret file doesn't exist (skip, warn, fail)")
+	o.timeout = fs.Duration("timeout", 0, "Kill the docker command if it doesn't finish in the given time, e.g. 5m (default no timeout)")
+	o.hashConcurrency = fs.Int("hash-concurrency", runtime.NumCPU(), "Maximum number of files hashed at the same time")
+	o.hashCachePath = fs.String("hash-cache", "", "File used to cache the hashes of unchanged config and secret files")
+	o.retries = fs.Int("retries", 0, "Retry the deploy this many times when docker fails with a connection error or timeout")
+	o.retryDelay = fs.Duration("retry-delay", 2*time.Second, "Delay before the first retry, doubled after each attempt")
+	o.envFD = fs.Int("env-fd", -1, "Write the generated variables as KEY=VALUE lines to this file descriptor, opened by the parent process")
+	o.metricsFile = fs.String("metrics-file", "", "Write prometheus metrics of the deploys to this file, for the node_exporter textfile collector")
+	o.summaryFile = fs.String("summary-file", "", "Write a json summary of the deploys, with their exit code and duration, to this file")
+	o.stateFile = fs.String("state-file", "", "File recording the generated variables of the last successful deploy")
+	o.lockfile = fs.String("lockfile", "", "Fail when the generated variables differ from the ones recorded in this file")
+	o.updateLock = fs.Bool("update-lock", false, "Write the generated variables to the --lockfile instead of checking them")
+	o.manifestFile = fs.String("manifest", "", "Deploy in sequence the stacks listed in a manifest file")
+	o.failFast = fs.Bool("fail-fast", false, "Stop deploying the manifest stacks or to the next hosts after the first failure")
+	o.preDeploy = fs.String("pre-deploy", "", "Shell command run before generating the variables, its failure aborts the deploy")
+	o.postDeploy = fs.String("post-deploy", "", "Shell command run after a successful deploy, its failure makes the deploy fail")
+	o.requireCleanBuild = fs.Bool("require-clean-build", false, "Refuse to deploy with a binary built from modified sources")
+	o.version = fs.StringP("version", "v", "", "Show version, as text or json")
+
+	fs.Lookup("version").NoOptDefVal = "text"
+
+	return o
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, newExecRunner))
+}
+
+// run executes docker-deploy with the given command line arguments, running docker and the hooks with the runners
+// returned by newRunner for the settings of the flags, and returns the exit code
+func run(cliArgs []string, stdin io.Reader, stdout, stderr io.Writer, newRunner func(runnerOptions) commandRunner) int {
+	logger = &deployLogger{out: stderr, level: levelInfo}
+
+	// the completion subcommand is not listed in the usage, it is only meant to be run from the shell startup files
+	if len(cliArgs) > 0 && cliArgs[0] == "completion" {
+		if len(cliArgs) != 2 {
+			return logger.failf(exitUsage, "Usage: docker-deploy completion [%s]", strings.Join(completionShells, "|"))
+		}
+
+		if err := writeCompletion(stdout, cliArgs[1], newOptions(stderr).flags); err != nil {
+			return logger.fail(exitUsage, err)
+		}
+		return 0
+	}
+
+	// the env subcommand only prints the generated variables, it has to be the first argument so it cannot be
+	// confused with a stack name
+	printEnv := len(cliArgs) > 0 && cliArgs[0] == "env"
+	if printEnv {
+		cliArgs = cliArgs[1:]
+	}
+
+	o := newOptions(stderr)
+	err := o.flags.Parse(cliArgs)
+
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if err := logger.setFormat(*o.logFormat); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if err := logger.setColor(*o.color); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if *o.quiet && (*o.verbose > 0 || *o.dryRun) {
+		return logger.failf(exitUsage, "--quiet cannot be combined with --verbose or --dry-run")
+	}
+
+	if *o.verbose > 0 {
+		logger.level = levelDebug
+	} else if *o.quiet {
+		logger.level = levelWarn
+	}
+
+	if err := validateEnvOutput(*o.envOutput); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if o.flags.Changed("env-output") && !printEnv {
+		return logger.failf(exitUsage, "--env-output can only be used with the env subcommand")
+	}
+
+	loadVersionInfo()
+
+	if *o.version != "" {
+		if err := printVersion(stdout, *o.version); err != nil {
+			return logger.fail(exitUsage, err)
+		}
+		return 0
+	}
+
+	if *o.workingDir != "" {
+		restore, err := changeDir(*o.workingDir)
+		if err != nil {
+			return logger.fail(exitUsage, err)
+		}
+		defer restore()
+	}
+
+	if *o.logFile != "" {
+		// the log file is only for auditing, not being able to write it doesn't prevent the deploy
+		file, err := os.OpenFile(*o.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Warnf("Cannot open the log file, logging to stderr only: %s", err.Error())
+		} else {
+			defer func() { _ = file.Close() }()
+			logger.addOutput(file)
+		}
+	}
+
+	if *o.trace || *o.traceFile != "" {
+		var mask *regexp.Regexp
+		if *o.maskPattern != "" {
+			var err error
+			mask, err = regexp.Compile(*o.maskPattern)
+			if err != nil {
+				return logger.failf(exitUsage, "Invalid --mask-pattern: %s", err)
+			}
+		}
+
+		out := stderr
+		if *o.traceFile != "" {
+			file, err := os.Create(*o.traceFile)
+			if err != nil {
+				return logger.failf(exitUsage, "Cannot create the trace file: %s", err)
+			}
+			defer func() { _ = file.Close() }()
+			out = file
+		}
+
+		trace.enable(out, mask)
+		defer trace.enable(nil, nil)
+		trace.Printf("docker-deploy %s (%s), arguments %q", Tag, Revision, cliArgs)
+	}
+
+	// the summary is written whatever the outcome, with the deploys attempted until then, so a run failing early
+	// doesn't leave the one of a previous run
+	summary := &runSummary{}
+	if *o.summaryFile != "" {
+		defer func() {
+			if err := summary.save(*o.summaryFile); err != nil {
+				logger.Warnf("Cannot write the summary file %s: %s", *o.summaryFile, err.Error())
+			}
+		}()
+	}
+
+	// the env subcommand and the dry runs, --prune-dry-run included, don't deploy anything, there is nothing to scrape
+	if *o.metricsFile != "" && !printEnv && !*o.dryRun && !*o.pruneDryRun {
+		defer func() {
+			if len(summary.Deploys) == 0 {
+				return
+			}
+			if err := summary.saveMetrics(*o.metricsFile); err != nil {
+				logger.Warnf("Cannot write the metrics file %s: %s", *o.metricsFile, err.Error())
+			}
+		}()
+	}
+
+	var envFD *os.File
+	if o.flags.Changed("env-fd") {
+		envFD, err = openEnvFD(*o.envFD)
+		if err != nil {
+			return logger.failf(exitUsage, "Invalid --env-fd: %s", err)
+		}
+		defer func() { _ = envFD.Close() }()
+	}
+
+	if *o.requireCleanBuild && Modified && !printEnv {
+		return logger.failf(exitUsage, "Refusing to deploy with a binary built from modified or unknown sources (commit %s), see --require-clean-build", Revision)
+	}
+
+	if err := validateMode(*o.mode, deploySettings{ResolveImage: *o.resolveImage, Orchestrator: *o.orchestrator, RegistryAuth: *o.auth}); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	switch *o.resolveImage {
+	case "", "always", "changed", "never":
+	default:
+		return logger.failf(exitUsage, "Invalid --resolve-image value %q, valid values are: always, changed, never", *o.resolveImage)
+	}
+
+	switch *o.orchestrator {
+	case "", "swarm", "kubernetes":
+	default:
+		return logger.failf(exitUsage, "Invalid --orchestrator value %q, valid values are: swarm, kubernetes", *o.orchestrator)
+	}
+
+	if *o.noHash && (o.flags.Changed("hash-algo") || o.flags.Changed("hash-length")) {
+		logger.Warnf("--hash-algo and --hash-length have no effect with --no-hash")
+	}
+
+	maxFileSize, err := parseByteSize(*o.maxFileSize)
+	if err != nil {
+		return logger.failf(exitUsage, "Invalid --max-file-size: %s", err)
+	}
+
+	hashOpts := hashOptions{Algo: *o.hashAlgo, Length: *o.hashLength, NormalizeEOL: *o.normalizeEOL, Source: *o.hashSource, MaxFileSize: maxFileSize}
+	if err := hashOpts.validate(); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if *o.annotate && (printEnv || *o.noHash) {
+		return logger.failf(exitUsage, "--annotate cannot be used with the env subcommand or --no-hash")
+	}
+
+	// the rendered files are temporary, the labels and the backup would be written next to them
+	if *o.annotate && *o.template {
+		return logger.failf(exitUsage, "--annotate cannot be used with --template")
+	}
+
+	if *o.requireHashes && *o.noHash {
+		return logger.failf(exitUsage, "--require-hashes cannot be used with --no-hash")
+	}
+
+	if *o.pruneDryRun && (printEnv || *o.mode != modeStack) {
+		return logger.failf(exitUsage, "--prune-dry-run is only supported when deploying in stack mode")
+	}
+
+	if *o.lockfile != "" && *o.noHash {
+		return logger.failf(exitUsage, "--lockfile cannot be used with --no-hash")
+	}
+
+	if *o.updateLock && *o.lockfile == "" {
+		return logger.failf(exitUsage, "--update-lock requires --lockfile")
+	}
+
+	if *o.retries < 0 {
+		return logger.failf(exitUsage, "Invalid --retries value %d, must not be negative", *o.retries)
+	}
+
+	var inherit []string
+	if o.flags.Changed("inherit-env") || *o.cleanEnv {
+		inherit, err = inheritedEnvNames(*o.inheritEnv, *o.cleanEnv)
+		if err != nil {
+			return logger.failf(exitUsage, "Invalid --inherit-env: %s", err)
+		}
+	}
+
+	if *o.hashConcurrency < 1 {
+		return logger.failf(exitUsage, "Invalid --hash-concurrency value %d, must be at least 1", *o.hashConcurrency)
+	}
+
+	if *o.hashCachePath != "" {
+		hashOpts.Cache = loadHashCache(*o.hashCachePath)
+	}
+
+	// the digests are kept for the whole run so the files shared by the stacks of a manifest or deployed to several
+	// hosts are only read once. A pre-deploy hook could change the files, then each stack hashes them again.
+	if *o.preDeploy == "" {
+		hashOpts.Memo = newHashMemo()
+	}
+
+	nameTmpl, err := parseEnvNameTemplate(*o.envNameTemplate)
+	if err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	prefix, err := sanitizeEnvPrefix(*o.envPrefix)
+	if err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	if err := validateOnMissingFile(*o.onMissingFile); err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	for _, pattern := range *o.ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return logger.failf(exitUsage, "Invalid --ignore pattern %q: %s", pattern, err)
+		}
+	}
+
+	if *o.fingerprintEnv != "" {
+		if err := validateEnvName(*o.fingerprintEnv); err != nil {
+			return logger.failf(exitUsage, "Invalid --fingerprint-env: %s", err)
+		}
+	}
+
+	forceEnv := ""
+	if *o.force {
+		if err := validateEnvName(*o.forceEnvName); err != nil {
+			return logger.failf(exitUsage, "Invalid --force-env-name: %s", err)
+		}
+		// the same value is used for every stack of a manifest
+		forceEnv = *o.forceEnvName + "=" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	// the env files are loaded first so their values can be used in the config and secret paths
+	fileEnv, err := loadEnvFiles(*o.envFiles)
+	if err != nil {
+		return logger.fail(exitConfig, err)
+	}
+
+	labels, err := labelEnv(*o.deployLabels)
+	if err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	images, err := imageEnv(*o.imageTag, *o.images)
+	if err != nil {
+		return logger.fail(exitUsage, err)
+	}
+
+	// the labels and image tags are given explicitly so they win over the env files
+	fileEnv = append(append(fileEnv, labels...), images...)
+
+	envOpts := envOptions{
+		Hash:                hashOpts,
+		NameTemplate:        nameTmpl,
+		Prefix:              prefix,
+		FailOnCollision:     *o.failOnCollision,
+		OnMissingFile:       *o.onMissingFile,
+		Lookup:              newEnvLookup(fileEnv, os.Environ()),
+		StrictInterpolation: *o.strictInterpolation,
+		Concurrency:         *o.hashConcurrency,
+		Ignore:              *o.ignore,
+		FingerprintName:     *o.fingerprintEnv,
+		CheckPermissions:    *o.checkPermissions || *o.strictPermissions,
+		StrictPermissions:   *o.strictPermissions,
+		StdinName:           *o.stdinName,
+	}
+
+	if *o.stateFile != "" {
+		envOpts.PreviousState = loadDeployState(*o.stateFile)
+	}
+
+	if *o.annotate {
+		envOpts.Annotations = newComposeAnnotations()
+	}
+
+	// the flag takes precedence over the environment, which takes precedence over the default names
+	configName := *o.configFile
+	if configName == "" {
+		configName = os.Getenv(configEnvVar)
+	}
+
+	configFiles := defaultConfigFiles
+	if configName != "" {
+		configFiles = []string{configName}
+	}
+
+	// an absolute --config is a single file, there is nothing to merge
+	cfg, err := loadAppConfig(configFiles, configName != "", *o.mergeConfigs)
+	if err != nil {
+		return logger.fail(exitCodeOf(err, exitConfig), err)
+	}
+
+	// without any environment in the config file the name only selects the x-environments of the compose files
+	if *o.environment != "" && len(cfg.Environments) == 0 {
+		logger.Debugf("No environments defined in the config file, the %s environment only selects the configs and secrets", *o.environment)
+	} else if *o.environment != "" {
+		cfg, err = cfg.forEnvironment(*o.environment)
+		if err != nil {
+			return logger.fail(exitConfig, err)
+		}
+		logger.Debugf("Using the %s environment", *o.environment)
+	}
+
+	envOpts.Environment = *o.environment
+	envOpts.KnownEnvironments = cfg.Environments
+
+	// the config file is the baseline of these flags, a flag given in the command line wins even when false
+	if cfg.Prune != nil && !o.flags.Changed("prune") {
+		*o.prune = *cfg.Prune
+		logger.Debugf("Using prune %t from the config file", *o.prune)
+	}
+
+	if cfg.RegistryAuth != nil && !o.flags.Changed("with-registry-auth") {
+		*o.auth = *cfg.RegistryAuth
+		logger.Debugf("Using registry auth %t from the config file", *o.auth)
+	}
+
+	dockerBinary := "docker"
+	if !printEnv {
+		dockerBinary, err = resolveDockerBinary(*o.dockerBin, cfg.DockerBinary)
+		if errors.Is(err, exec.ErrNotFound) {
+			return logger.fail(exitNotFound, err)
+		} else if err != nil {
+			return logger.fail(exitDocker, err)
+		}
+	}
+
+	daemonHosts, daemonContext, err := resolveDaemon(*o.hosts, *o.dockerContext, cfg)
+	if err != nil {
+		if len(*o.hosts) > 0 || *o.dockerContext != "" {
+			return logger.fail(exitUsage, err)
+		}
+		return logger.fail(exitConfig, err)
+	}
+
+	// the variables of docker take precedence over its config file, docker would use them anyway
+	if *o.dockerConfigContext && len(daemonHosts) == 0 && daemonContext == "" &&
+		os.Getenv("DOCKER_HOST") == "" && os.Getenv("DOCKER_CONTEXT") == "" {
+		daemonContext, err = currentDockerContext()
+		if err != nil {
+			return logger.fail(exitConfig, err)
+		}
+	}
+
+	var stacks []stackDeploy
+	if *o.manifestFile != "" {
+		if len(o.flags.Args()) > 0 {
+			return logger.failf(exitUsage, "No stack names or extra arguments can be given with --manifest")
+		}
+
+		if *o.stateFile != "" || *o.lockfile != "" {
+			return logger.failf(exitUsage, "--state-file and --lockfile cannot be used with --manifest")
+		}
+
+		stacks, err = loadManifest(*o.manifestFile)
+		if err != nil {
+			return logger.fail(exitConfig, err)
+		}
+	} else {
+		// explicit flags override the config file, which overrides the flag default
+		composeList := *o.composeFiles
+		if *o.composeFileFromEnv != "" {
+			envList, err := composeFilesFromEnv(*o.composeFileFromEnv)
+			if err != nil {
+				return logger.fail(exitUsage, err)
+			}
+
+			// the files given with --compose-file are added after the ones of the variable
+			if o.flags.Changed("compose-file") {
+				composeList = append(envList, composeList...)
+			} else {
+				composeList = envList
+			}
+		} else if !o.flags.Changed("compose-file") {
+			if len(cfg.ComposeFiles) > 0 {
+				composeList = cfg.ComposeFiles
+			} else {
+				// the default file is only used when it exists, docker would fail later with a less clear error
+				if err := checkDefaultComposeFile(); err != nil {
+					return logger.fail(exitCompose, err)
+				}
+
+				if !*o.noOverride {
+					composeList = withOverrideFile(composeList)
+				}
+			}
+		}
+
+		// the remote files are downloaded first as their URLs could look like glob patterns
+		for _, file := range composeList {
+			if !isRemoteComposeFile(file) {
+				continue
+			}
+
+			// like the rendered ones, the downloaded files are removed once deployed
+			if *o.annotate {
+				return logger.failf(exitUsage, "--annotate cannot be used with a compose file downloaded from an https URL")
+			}
+
+			client, err := newRemoteClient(*o.caCert)
+			if err != nil {
+				return logger.failf(exitUsage, "Invalid --ca-cert: %s", err)
+			}
+
+			fetched, cleanup, err := fetchComposeFiles(composeList, client)
+			defer cleanup()
+			if err != nil {
+				return logger.fail(exitCompose, err)
+			}
+			composeList = fetched
+			break
+		}
+
+		files, err := expandComposeFiles(composeList)
+		if err != nil {
+			return logger.fail(exitCompose, err)
+		}
+
+		if err := checkComposeFiles(files); err != nil {
+			return logger.fail(exitCompose, err)
+		}
+
+		stackName, source, err := resolveStackName(o.flags.Args(), cfg, !*o.strictName)
+		if err != nil {
+			return logger.fail(exitError, err)
+		}
+
+		extraArgs := o.flags.Args()
+		if len(extraArgs) > 0 {
+			extraArgs = extraArgs[1:]
+		}
+
+		stacks = []stackDeploy{{Name: stackName, Source: source, ComposeFiles: files, ExtraArgs: extraArgs}}
+	}
+
+	if *o.stdinName != "" && !readsStdin(stacks) {
+		logger.Warnf("--stdin-name has no effect, no compose file is read from stdin")
+	}
+
+	if *o.namePrefix != "" || *o.nameSuffix != "" {
+		for i, stack := range stacks {
+			name, err := decorateStackName(stack.Name, *o.namePrefix, *o.nameSuffix)
+			if err != nil {
+				return logger.fail(exitUsage, err)
+			}
+
+			logger.Debugf("Decorated stack name %s to %s", stack.Name, name)
+			stacks[i].Name = name
+		}
+	}
+
+	if *o.template {
+		env := newDeployState(append(os.Environ(), fileEnv...))
+
+		for i, stack := range stacks {
+			for _, file := range stack.ComposeFiles {
+				if file == "-" {
+					return logger.failf(exitUsage, "--template cannot render a compose file read from stdin")
+				}
+			}
+
+			rendered, cleanup, err := renderComposeFiles(stack.ComposeFiles, templateData{Stack: stack.Name, Env: env, Config: cfg})
+			defer cleanup()
+			if err != nil {
+				return logger.fail(exitCompose, err)
+			}
+			stacks[i].ComposeFiles = rendered
+		}
+	}
+
+	// every stack is deployed to each host in turn, the env subcommand doesn't run docker so it only needs one of them
+	if len(daemonHosts) > 0 {
+		hosts := daemonHosts
+		if printEnv {
+			hosts = hosts[:1]
+		}
+
+		targets := make([]stackDeploy, 0, len(stacks)*len(hosts))
+		for _, stack := range stacks {
+			for _, host := range hosts {
+				stack.Host = host
+				targets = append(targets, stack)
+			}
+		}
+		stacks = targets
+	}
+
+	d := &deployer{
+		opts:       o,
+		runner:     newRunner(runnerOptions{Timeout: *o.timeout, Inherit: inherit}),
+		hookRunner: newRunner(runnerOptions{Inherit: inherit}),
+		stdin:      stdin,
+		stdout:     stdout,
+		stderr:     stderr,
+		binary:     dockerBinary,
+		context:    daemonContext,
+		fileEnv:    fileEnv,
+		envOpts:    envOpts,
+		printEnv:   printEnv,
+		forceEnv:   forceEnv,
+		summary:    summary,
+	}
+
+	// the targets are deployed in turn, each one needs the whole compose file given on stdin
+	if readsStdin(stacks) {
+		d.stdinCompose, err = ioutil.ReadAll(stdin)
+		if err != nil {
+			return logger.failf(exitCompose, "Cannot read the compose file from stdin: %s", err)
+		}
+	}
+
+	if cfg.Production {
+		d.production = true
+		logger.Debugf("The config file marks the daemon as production, each deploy has to be confirmed")
+	}
+
+	// a nil *os.File would not be a nil io.Writer
+	if envFD != nil {
+		d.envFD = envFD
+		d.envFDStacks = make(map[string]bool)
+	}
+
+	if *o.outputPrefix != "" {
+		d.outputPrefix, err = template.New("output-prefix").Parse(*o.outputPrefix)
+		if err == nil {
+			// rendered once to catch unknown fields before deploying anything
+			err = d.outputPrefix.Execute(io.Discard, outputPrefixData{})
+		}
+		if err != nil {
+			return logger.failf(exitUsage, "Invalid --output-prefix template: %s", err)
+		}
+	}
+
+	if *o.maskPattern != "" {
+		d.mask, err = regexp.Compile(*o.maskPattern)
+		if err != nil {
+			return logger.failf(exitUsage, "Invalid --mask-pattern: %s", err)
+		}
+		d.maskDryRun = o.flags.Changed("mask-pattern")
+	}
+
+	if len(stacks) == 1 {
+		code, err := d.deploy(stacks[0])
+		if err != nil {
+			return logger.fail(exitCodeOf(err, code), err)
+		}
+		return code
+	}
+
+	// the failures are reported at the end so one failing stack doesn't prevent the others from being deployed
+	var failed []string
+	exitStatus := 0
+	// the status of each host is repeated at the end, the deploys can have a long output
+	statuses := make([]string, 0, len(stacks))
+	for _, stack := range stacks {
+		target := stack.Name
+		if len(daemonHosts) > 1 {
+			target += " on " + stack.Host
+		}
+
+		code, err := d.deploy(stack)
+		if err != nil {
+			logger.Errorf("%s", err)
+			code = exitCodeOf(err, code)
+		}
+
+		if code == 0 {
+			if len(daemonHosts) > 1 && !printEnv {
+				logger.Infof("Deployed stack %s", target)
+			}
+			statuses = append(statuses, fmt.Sprintf("%s: deployed", target))
+			continue
+		}
+
+		logger.Errorf("Deploy of stack %s failed with exit code %d", target, code)
+		statuses = append(statuses, fmt.Sprintf("%s: failed with exit code %d", target, code))
+		failed = append(failed, target)
+		if exitStatus == 0 {
+			exitStatus = code
+		}
+
+		if *o.failFast {
+			break
+		}
+	}
+
+	if len(daemonHosts) > 1 && !printEnv {
+		for _, stack := range stacks[len(statuses):] {
+			statuses = append(statuses, fmt.Sprintf("%s on %s: not deployed after the failure", stack.Name, stack.Host))
+		}
+		logger.Infof("Deploys by host:\n%s", strings.Join(statuses, "\n"))
+	}
+
+	if len(failed) > 0 {
+		return logger.failf(exitStatus, "%d of %d stacks failed to deploy: %s", len(failed), len(stacks), strings.Join(failed, ", "))
+	}
+
+	return 0
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// stubCall is a command run by the stubRunner
+type stubCall struct {
+	name  string
+	args  []string
+	env   []string
+	stdin []byte
+}
+
+// stubRunner records the commands instead of running them, they all exit with code
+type stubRunner struct {
+	calls []stubCall
+	code  int
+}
+
+func (r *stubRunner) Run(name string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	call := stubCall{name: name, args: args, env: env}
+	if stdin != nil {
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return -1, err
+		}
+		call.stdin = data
+	}
+	r.calls = append(r.calls, call)
+
+	return r.code, nil
+}
+
+// runStub runs docker-deploy from the testdata directory dir with the stub runner and returns its exit code
+func runStub(t *testing.T, r *stubRunner, dir, stdin string, args ...string) int {
+	t.Helper()
+
+	// the daemon and the config file of the machine running the tests must not leak into the commands
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("DOCKER_CONTEXT", "")
+	t.Setenv(configEnvVar, "")
+
+	var stderr bytes.Buffer
+	cliArgs := append([]string{"--working-dir", "testdata/" + dir}, args...)
+	code := run(cliArgs, strings.NewReader(stdin), ioutil.Discard, &stderr, func(runnerOptions) commandRunner { return r })
+	if code != 0 {
+		t.Logf("docker-deploy %s exited with code %d:\n%s", strings.Join(cliArgs, " "), code, stderr.String())
+	}
+
+	return code
+}
+
+func TestDeployCommand(t *testing.T) {
+	appEnv := []string{"APP_CONF=f7407318bd2c4a39"}
+
+	tests := []struct {
+		name string
+		dir  string
+		args []string
+		want [][]string
+	}{
+		{
+			name: "local daemon",
+			dir:  "deploy",
+			args: []string{"web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "web"}},
+		},
+		{
+			name: "host",
+			dir:  "deploy",
+			args: []string{"-H", "tcp://a:2376", "web"},
+			want: [][]string{{"--host", "tcp://a:2376", "stack", "deploy", "--compose-file", "docker-compose.yml", "web"}},
+		},
+		{
+			name: "every host in turn",
+			dir:  "deploy",
+			args: []string{"-H", "tcp://a:2376", "-H", "tcp://b:2376", "web"},
+			want: [][]string{
+				{"--host", "tcp://a:2376", "stack", "deploy", "--compose-file", "docker-compose.yml", "web"},
+				{"--host", "tcp://b:2376", "stack", "deploy", "--compose-file", "docker-compose.yml", "web"},
+			},
+		},
+		{
+			name: "context",
+			dir:  "deploy",
+			args: []string{"--context", "prod", "web"},
+			want: [][]string{{"--context", "prod", "stack", "deploy", "--compose-file", "docker-compose.yml", "web"}},
+		},
+		{
+			name: "compose mode",
+			dir:  "deploy",
+			args: []string{"--mode", "compose", "web"},
+			want: [][]string{{"compose", "--file", "docker-compose.yml", "--project-name", "web", "up", "--detach"}},
+		},
+		{
+			name: "compose mode attached to a host",
+			dir:  "deploy",
+			args: []string{"--mode", "compose", "--detach=false", "-H", "tcp://a:2376", "web"},
+			want: [][]string{{"--host", "tcp://a:2376", "compose", "--file", "docker-compose.yml", "--project-name", "web", "up"}},
+		},
+		{
+			name: "compose mode prune",
+			dir:  "deploy",
+			args: []string{"--mode", "compose", "--prune", "web"},
+			want: [][]string{{"compose", "--file", "docker-compose.yml", "--project-name", "web", "up", "--detach", "--remove-orphans"}},
+		},
+		{
+			name: "stack mode attached",
+			dir:  "deploy",
+			args: []string{"--detach=false", "web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "--detach=false", "web"}},
+		},
+		{
+			name: "prune and auth flags",
+			dir:  "deploy",
+			args: []string{"--prune", "--with-registry-auth", "web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "--with-registry-auth", "--prune", "web"}},
+		},
+		{
+			name: "prune and auth from the config",
+			dir:  "deploy-config",
+			args: []string{"web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "--with-registry-auth", "--prune", "web"}},
+		},
+		{
+			name: "flags override the config",
+			dir:  "deploy-config",
+			args: []string{"--prune=false", "--with-registry-auth=false", "web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "web"}},
+		},
+		{
+			name: "name prefix and suffix",
+			dir:  "deploy",
+			args: []string{"--name-prefix", "team-", "--name-suffix", "-staging", "web"},
+			want: [][]string{{"stack", "deploy", "--compose-file", "docker-compose.yml", "team-web-staging"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &stubRunner{}
+			if code := runStub(t, r, tt.dir, "", tt.args...); code != 0 {
+				t.Fatalf("got exit code %d, want 0", code)
+			}
+
+			if len(r.calls) != len(tt.want) {
+				t.Fatalf("got %d commands, want %d", len(r.calls), len(tt.want))
+			}
+			for i, call := range r.calls {
+				if call.name != "docker" {
+					t.Errorf("command %d ran %s, want docker", i, call.name)
+				}
+				if !reflect.DeepEqual(call.args, tt.want[i]) {
+					t.Errorf("command %d got args %q, want %q", i, call.args, tt.want[i])
+				}
+				if !reflect.DeepEqual(call.env, appEnv) {
+					t.Errorf("command %d got env %q, want %q", i, call.env, appEnv)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployDockerExitCode(t *testing.T) {
+	r := &stubRunner{code: 42}
+	if code := runStub(t, r, "deploy", "", "web"); code != 42 {
+		t.Errorf("got exit code %d, want the docker exit code 42", code)
+	}
+}
+
+func TestDeployHashOptionsPerEntry(t *testing.T) {
+	r := &stubRunner{}
+	if code := runStub(t, r, "hash-options", "", "web"); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if len(r.calls) != 1 {
+		t.Fatalf("got %d commands, want 1", len(r.calls))
+	}
+
+	want := map[string]string{
+		// the global sha256 and 8 bytes
+		"A_CONF": "87428fc522803d31",
+		// x-hash-algo only
+		"B_CONF": "3b5d5c3712955042",
+		// x-hash-length only
+		"C_SECRET": "a3a5e715",
+		// both of them
+		"D_SECRET": "17048b13a1ddc906f8ea1aeef2696aee",
+	}
+
+	got := make(map[string]string)
+	for _, entry := range r.calls[0].env {
+		key, value, _ := strings.Cut(entry, "=")
+		got[key] = value
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got env %v, want %v", got, want)
+	}
+}
+
+func TestDeployInterpolatedPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want []string
+	}{
+		{name: "default", want: []string{"APP_CONF=65409c592c99d0f7"}},
+		{name: "variable", env: "prod", want: []string{"APP_CONF=d4c9ec2691096d4f"}},
+		{name: "env file", args: []string{"--env-file", "prod.env"}, want: []string{"APP_ENV=prod", "APP_CONF=d4c9ec2691096d4f"}},
+		{name: "strict with a default", args: []string{"--strict-interpolation"}, want: []string{"APP_CONF=65409c592c99d0f7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("APP_ENV", tt.env)
+
+			r := &stubRunner{}
+			if code := runStub(t, r, "interpolation", "", append(tt.args, "web")...); code != 0 {
+				t.Fatalf("got exit code %d, want 0", code)
+			}
+			if len(r.calls) != 1 {
+				t.Fatalf("got %d commands, want 1", len(r.calls))
+			}
+			if !reflect.DeepEqual(r.calls[0].env, tt.want) {
+				t.Errorf("got env %q, want %q", r.calls[0].env, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployYAMLAnchors(t *testing.T) {
+	r := &stubRunner{}
+	if code := runStub(t, r, "anchors", "", "web"); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	if len(r.calls) != 1 {
+		t.Fatalf("got %d commands, want 1", len(r.calls))
+	}
+
+	// the alias and the merge of the app config give a single variable, the merged secret shares the one of other
+	// and the include path is an alias too
+	want := []string{"APP_CONF=8a8f60ecb09b7e64", "OTHER_CONF=7e4fa2eb8c7ac089", "EXTRA_CONF=65110ea3b8b62b0c"}
+	if !reflect.DeepEqual(r.calls[0].env, want) {
+		t.Errorf("got env %q, want %q", r.calls[0].env, want)
+	}
+}
+
+func TestDeployComposeFileFromStdin(t *testing.T) {
+	compose, err := ioutil.ReadFile("testdata/deploy/docker-compose.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		calls int
+	}{
+		{name: "single host", args: []string{"-c", "-", "web"}, calls: 1},
+		{name: "every host", args: []string{"-c", "-", "-H", "tcp://a:2376", "-H", "tcp://b:2376", "web"}, calls: 2},
+		{name: "validated first", args: []string{"-c", "-", "--validate", "web"}, calls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &stubRunner{}
+			if code := runStub(t, r, "deploy", string(compose), tt.args...); code != 0 {
+				t.Fatalf("got exit code %d, want 0", code)
+			}
+			if len(r.calls) != tt.calls {
+				t.Fatalf("got %d commands, want %d", len(r.calls), tt.calls)
+			}
+
+			// the file is hashed on the way, docker still gets it whole and only once
+			for i, call := range r.calls {
+				if !bytes.Equal(call.stdin, compose) {
+					t.Errorf("command %d got %d bytes on stdin, want the %d bytes of the compose file", i, len(call.stdin), len(compose))
+				}
+				if want := []string{"APP_CONF=f7407318bd2c4a39"}; !reflect.DeepEqual(call.env, want) {
+					t.Errorf("command %d got env %q, want %q", i, call.env, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployOverlappingComposeFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want []string
+	}{
+		{
+			name: "shared with the override",
+			args: []string{"web"},
+			want: []string{"BASE_CONF=f34848ca92665c34", "SHARED_CONF=cf99975aa7995fad", "OVERRIDE_CONF=46e0313ca59003e4"},
+		},
+		{
+			name: "collision uses the last file",
+			args: []string{"-c", "docker-compose.yml", "-c", "docker-compose.prod.yml", "web"},
+			want: []string{"BASE_CONF=85e16f41ca6ca6d6", "SHARED_CONF=cf99975aa7995fad"},
+		},
+		{
+			name: "collision fails",
+			args: []string{"--fail-on-collision", "-c", "docker-compose.yml", "-c", "docker-compose.prod.yml", "web"},
+			code: exitCompose,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &stubRunner{}
+			if code := runStub(t, r, "overlap", "", tt.args...); code != tt.code {
+				t.Fatalf("got exit code %d, want %d", code, tt.code)
+			}
+
+			if tt.want == nil {
+				if len(r.calls) != 0 {
+					t.Errorf("got %d commands, want none", len(r.calls))
+				}
+				return
+			}
+
+			if len(r.calls) != 1 {
+				t.Fatalf("got %d commands, want 1", len(r.calls))
+			}
+			if !reflect.DeepEqual(r.calls[0].env, tt.want) {
+				t.Errorf("got env %q, want %q", r.calls[0].env, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployUsageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "annotate rendered files", args: []string{"--annotate", "--template", "web"}},
+		{name: "annotate downloaded files", args: []string{"--annotate", "-c", "https://example.com/docker-compose.yml", "web"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &stubRunner{}
+			if code := runStub(t, r, "deploy", "", tt.args...); code != exitUsage {
+				t.Errorf("got exit code %d, want %d", code, exitUsage)
+			}
+			if len(r.calls) != 0 {
+				t.Errorf("got %d commands, want none", len(r.calls))
+			}
+		})
+	}
+}
+
+func TestComposeFilesFromEnv(t *testing.T) {
+	sep := string(os.PathListSeparator)
+
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "commas", value: "a.yml, b.yml,", want: []string{"a.yml", "b.yml"}},
+		{name: "path list", value: "a.yml" + sep + "b.yml", want: []string{"a.yml", "b.yml"}},
+		{name: "url", value: "https://example.com/stack.yml", want: []string{"https://example.com/stack.yml"}},
+		{
+			name:  "urls and files",
+			value: "a.yml" + sep + "https://example.com/stack.yml,http://example.com:8080/override.yml,b.yml" + sep + "c.yml",
+			want:  []string{"a.yml", "https://example.com/stack.yml", "http://example.com:8080/override.yml", "b.yml", "c.yml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_COMPOSE_FILES", tt.value)
+
+			got, err := composeFilesFromEnv("TEST_COMPOSE_FILES")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployValidateFirst(t *testing.T) {
+	r := &stubRunner{}
+	if code := runStub(t, r, "invalid", "", "--validate", "--pre-deploy", "touch deployed", "web"); code != exitCompose {
+		t.Errorf("got exit code %d, want %d", code, exitCompose)
+	}
+
+	// neither the hook nor docker run for an invalid file
+	if len(r.calls) != 0 {
+		t.Errorf("got %d commands, want none", len(r.calls))
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"Path=C:\\Windows", "HOME=/home/deploy", "SECRET=hidden", "SystemRoot=C:\\Windows"}
+	names := []string{"PATH", "HOME", "SystemRoot"}
+
+	want := []string{"HOME=/home/deploy", "SystemRoot=C:\\Windows"}
+	if runtime.GOOS == "windows" {
+		want = []string{"Path=C:\\Windows", "HOME=/home/deploy", "SystemRoot=C:\\Windows"}
+	}
+
+	if got := filterEnv(env, names); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
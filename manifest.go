@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifest lists the stacks deployed in sequence by --manifest
+type manifest struct {
+	Stacks []manifestStack `yaml:"stacks"`
+}
+
+type manifestStack struct {
+	Name         string   `yaml:"name"`
+	ComposeFiles []string `yaml:"compose_files"`
+}
+
+// loadManifest reads the stacks of a manifest file, expanding and checking their compose files so no stack is
+// deployed when any of them is invalid
+func loadManifest(filename string) ([]stackDeploy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest %s: %w", filename, err)
+	}
+
+	if len(m.Stacks) == 0 {
+		return nil, fmt.Errorf("manifest %s doesn't list any stack", filename)
+	}
+
+	stacks := make([]stackDeploy, 0, len(m.Stacks))
+	seen := make(map[string]bool, len(m.Stacks))
+
+	for i, s := range m.Stacks {
+		if s.Name == "" {
+			return nil, fmt.Errorf("manifest %s: stack %d has no name", filename, i+1)
+		}
+
+		if seen[s.Name] {
+			return nil, fmt.Errorf("manifest %s: stack %s is listed twice", filename, s.Name)
+		}
+		seen[s.Name] = true
+
+		if len(s.ComposeFiles) == 0 {
+			return nil, fmt.Errorf("manifest %s: stack %s has no compose files", filename, s.Name)
+		}
+
+		files, err := expandComposeFiles(s.ComposeFiles)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: stack %s: %w", filename, s.Name, err)
+		}
+
+		for _, file := range files {
+			// stdin can only be read once
+			if file == "-" {
+				return nil, fmt.Errorf("manifest %s: stack %s cannot read a compose file from stdin", filename, s.Name)
+			}
+		}
+
+		if err := checkComposeFiles(files); err != nil {
+			return nil, fmt.Errorf("manifest %s: stack %s: %w", filename, s.Name, err)
+		}
+
+		stacks = append(stacks, stackDeploy{Name: s.Name, Source: stackNameFromManifest, ComposeFiles: files})
+	}
+
+	return stacks, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// metricsHelp are the metrics written to the --metrics-file, in the order they are written
+var metricsHelp = []struct {
+	name string
+	help string
+}{
+	{"docker_deploy_success", "Whether the last deploy of the stack succeeded."},
+	{"docker_deploy_duration_seconds", "Duration of the last deploy of the stack, hashing and retries included."},
+	{"docker_deploy_configs", "Number of variables generated from the configs and secrets of the stack."},
+	{"docker_deploy_timestamp_seconds", "Unix time the last deploy of the stack finished."},
+}
+
+// metrics renders the deploys in the text format of the node_exporter textfile collector, one sample of every
+// metric per deploy labelled with its stack and host
+func (s runSummary) metrics() []byte {
+	var buf bytes.Buffer
+
+	for _, metric := range metricsHelp {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+
+		for _, deploy := range s.Deploys {
+			labels := fmt.Sprintf(`stack="%s"`, escapeLabelValue(deploy.Stack))
+			if deploy.Host != "" {
+				labels += fmt.Sprintf(`,host="%s"`, escapeLabelValue(deploy.Host))
+			}
+
+			var value float64
+			switch metric.name {
+			case "docker_deploy_success":
+				if deploy.ExitCode == 0 && deploy.Error == "" {
+					value = 1
+				}
+			case "docker_deploy_duration_seconds":
+				value = deploy.elapsed.Seconds()
+			case "docker_deploy_configs":
+				value = float64(len(deploy.Env))
+			case "docker_deploy_timestamp_seconds":
+				value = float64(deploy.finished.Unix())
+			}
+
+			fmt.Fprintf(&buf, "%s{%s} %s\n", metric.name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// escapeLabelValue escapes a label value of the text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// saveMetrics replaces the metrics file atomically, the collector never reads a partial file since the temporary one
+// doesn't have the .prom extension. The file is readable by everyone as the collector usually runs as its own user.
+func (s runSummary) saveMetrics(path string) error {
+	return writeFileAtomic(path, s.metrics(), 0644)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// formats of the variables printed by the env subcommand
+const (
+	envOutputDotenv = "dotenv"
+	envOutputYAML   = "yaml"
+	envOutputJSON   = "json"
+)
+
+func validateEnvOutput(format string) error {
+	switch format {
+	case envOutputDotenv, envOutputYAML, envOutputJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid env output %q, valid values are: dotenv, yaml, json", format)
+	}
+}
+
+// writeEnv writes the KEY=VALUE entries in the given format. The yaml and json mappings are sorted by name while the
+// dotenv lines keep the generated order. When a stack name is given the entries are labelled with it: preceded by a
+// comment line in dotenv, nested under the name in yaml and json.
+func writeEnv(w io.Writer, env []string, format, stack string) error {
+	if format == envOutputDotenv {
+		if stack != "" {
+			if _, err := fmt.Fprintf(w, "# %s\n", stack); err != nil {
+				return err
+			}
+		}
+		for _, entry := range env {
+			if _, err := fmt.Fprintln(w, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var values interface{} = map[string]string(newDeployState(env))
+	if stack != "" {
+		values = map[string]interface{}{stack: values}
+	}
+
+	if format == envOutputYAML {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(values); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
+
+// openEnvFD returns the file of an inherited file descriptor for --env-fd, checking that it is open for writing
+func openEnvFD(fd int) (*os.File, error) {
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+	if _, err := file.Stat(); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not open", fd)
+	}
+
+	// an empty write still reaches the system, which rejects a descriptor opened read only
+	if _, err := file.Write(nil); err != nil {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, fmt.Errorf("file descriptor %d is not writable: %w", fd, err)
+	}
+
+	return file, nil
+}
+
+// prefixWriter writes the prefix at the start of every line. Partial lines are written as they come, the prefix is
+// held until the first byte of the next line so the output is never delayed waiting for a newline.
+type prefixWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func newPrefixWriter(out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{out: out, prefix: []byte(prefix)}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n := len(p)
+
+	var buf bytes.Buffer
+	for len(p) > 0 {
+		if !w.midLine {
+			buf.Write(w.prefix)
+			w.midLine = true
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			buf.Write(p)
+			break
+		}
+
+		buf.Write(p[:i+1])
+		p = p[i+1:]
+		w.midLine = false
+	}
+
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// composeServices holds the services of a compose file, only their names are used
+type composeServices struct {
+	Services map[string]yaml.Node `yaml:"services"`
+}
+
+// composeServiceNames returns the names of the services defined by the compose files. The included files are not
+// read.
+func composeServiceNames(filenames []string, stdin io.Reader) (map[string]bool, error) {
+	names := make(map[string]bool)
+
+	for _, filename := range filenames {
+		var data []byte
+		var err error
+
+		if filename == "-" {
+			data, err = ioutil.ReadAll(stdin)
+		} else {
+			data, err = ioutil.ReadFile(filename)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc composeServices
+			err := decoder.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, &ComposeParseError{File: filename, Err: err}
+			}
+
+			for name := range doc.Services {
+				names[name] = true
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// reportPrunable lists the services of the deployed stack that are not in its compose files anymore, the ones a
+// deploy with --prune would remove, without deploying anything
+func (d *deployer) reportPrunable(stack stackDeploy) (int, error) {
+	services, err := composeServiceNames(stack.ComposeFiles, d.composeStdin())
+	if err != nil {
+		return exitCompose, fmt.Errorf("local compose files: %w", err)
+	}
+
+	args := daemonArgs(deploySettings{Host: stack.Host, Context: d.context})
+	args = append(args, "stack", "services", "--format", "{{.Name}}", stack.Name)
+
+	logger.With(logFields{"command": append([]string{d.binary}, args...)}).
+		Debugf("Running: %s %v", d.binary, strings.Join(args, " "))
+
+	var out bytes.Buffer
+	code, err := d.runner.Run(d.binary, args, nil, nil, &out, d.stderr)
+	if err != nil {
+		return exitDocker, fmt.Errorf("cannot list the services of the stack %s: %w", stack.Name, err)
+	}
+	if code != 0 {
+		return code, &DockerExecError{Daemon: d.daemonName(stack), Code: code}
+	}
+
+	// the swarm services are named after the stack and the compose service
+	var prunable []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
+		}
+
+		if !services[strings.TrimPrefix(name, stack.Name+"_")] {
+			prunable = append(prunable, name)
+		}
+	}
+	sort.Strings(prunable)
+
+	if len(prunable) == 0 {
+		logger.Infof("No service of the stack %s would be pruned", stack.Name)
+		return 0, nil
+	}
+
+	for _, name := range prunable {
+		logger.With(logFields{"service": name}).Infof("Would be pruned: %s", name)
+	}
+	logger.Infof("%d services of the stack %s would be pruned", len(prunable), stack.Name)
+
+	return 0, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// remoteTimeout bounds the download of each remote compose file
+const remoteTimeout = time.Minute
+
+// isRemoteComposeFile reports whether the compose file is fetched over http or https
+func isRemoteComposeFile(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// newRemoteClient returns the client used to fetch the compose files, trusting the certificates of the caCert file
+// on top of the system ones
+func newRemoteClient(caCert string) (*http.Client, error) {
+	client := &http.Client{Timeout: remoteTimeout}
+
+	if caCert == "" {
+		return client, nil
+	}
+
+	pem, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caCert)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	client.Transport = transport
+
+	return client, nil
+}
+
+// fetchComposeFiles downloads the http and https compose files into hidden temporary files of the current directory,
+// so the relative paths inside resolve from it, and returns the list with their local names. The credentials of the
+// URL are sent with basic auth. The returned function removes the downloaded files, it has to be called even on
+// error.
+func fetchComposeFiles(files []string, client *http.Client) ([]string, func(), error) {
+	var fetched []string
+
+	cleanup := func() {
+		for _, file := range fetched {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				logger.Warnf("Cannot remove the downloaded compose file %s: %s", file, err.Error())
+			}
+		}
+	}
+
+	local := make([]string, 0, len(files))
+	for _, file := range files {
+		if !isRemoteComposeFile(file) {
+			local = append(local, file)
+			continue
+		}
+
+		out, err := fetchComposeFile(file, client)
+		if out != "" {
+			fetched = append(fetched, out)
+		}
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		local = append(local, out)
+	}
+
+	return local, cleanup, nil
+}
+
+func fetchComposeFile(rawURL string, client *http.Client) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid compose file URL: %w", err)
+	}
+
+	// the password is never logged
+	name := u.Redacted()
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid compose file URL %s: %w", name, err)
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.URL.User = nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// the error of the client includes the URL
+		return "", fmt.Errorf("cannot fetch compose file %s: %w", name, unwrapURLError(err))
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("cannot fetch compose file %s: %s", name, resp.Status)
+	}
+
+	out, err := ioutil.TempFile(".", ".docker-deploy-*.yml")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return out.Name(), fmt.Errorf("cannot fetch compose file %s: %w", name, err)
+	}
+
+	logger.With(logFields{"file": name}).Debugf("Downloaded compose file %s to %s", name, out.Name())
+
+	return out.Name(), nil
+}
+
+// unwrapURLError drops the url.Error wrapper, which would show the URL with its password
+func unwrapURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// deployState maps the generated variables to their values at the last successful deploy
+type deployState map[string]string
+
+// loadDeployState reads the state file, a missing or unreadable file is an empty state so every variable shows as added
+func loadDeployState(path string) deployState {
+	state := make(deployState)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("Ignoring state file %s: %s", path, err.Error())
+		}
+		return state
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Warnf("Ignoring state file %s: %s", path, err.Error())
+		return make(deployState)
+	}
+
+	return state
+}
+
+// newDeployState builds the state from KEY=VALUE entries
+func newDeployState(env []string) deployState {
+	state := make(deployState, len(env))
+
+	for _, entry := range env {
+		key, value, _ := strings.Cut(entry, "=")
+		state[key] = value
+	}
+
+	return state
+}
+
+// save replaces the state file atomically
+func (s deployState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// logChanges logs the variables that changed, were added or were removed since the previous state
+func (s deployState) logChanges(current map[string]string) {
+	var changed, added, removed []string
+
+	for key, value := range current {
+		previous, ok := s[key]
+		if !ok {
+			added = append(added, key)
+		} else if previous != value {
+			changed = append(changed, key)
+		}
+	}
+
+	for key := range s {
+		if _, ok := current[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	if len(changed)+len(added)+len(removed) == 0 {
+		logger.Infof("No config or secret changed since the last deploy")
+		return
+	}
+
+	sort.Strings(changed)
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	for _, key := range changed {
+		logger.With(logFields{"env": []string{key + "=" + current[key]}}).
+			Infof("Changed since the last deploy: %s (%s -> %s)", key, s[key], current[key])
+	}
+
+	for _, key := range added {
+		logger.With(logFields{"env": []string{key + "=" + current[key]}}).
+			Infof("Added since the last deploy: %s", key)
+	}
+
+	for _, key := range removed {
+		logger.With(logFields{"env": []string{key + "=" + s[key]}}).
+			Infof("Removed since the last deploy: %s", key)
+	}
+
+	logger.Infof("%d changed, %d added and %d removed since the last deploy", len(changed), len(added), len(removed))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// runSummary is written to the --summary-file at the end of a run, with one entry per deploy attempted
+type runSummary struct {
+	Deploys []deploySummary `json:"deploys"`
+}
+
+// deploySummary is the result of deploying a stack. Only the names of the generated variables are recorded so the
+// file can be shared, the duration is the one of the docker command including its retries.
+type deploySummary struct {
+	Stack           string   `json:"stack"`
+	Host            string   `json:"host,omitempty"`
+	Context         string   `json:"context,omitempty"`
+	ComposeFiles    []string `json:"compose_files"`
+	Env             []string `json:"env"`
+	ExitCode        int      `json:"exit_code"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	Error           string   `json:"error,omitempty"`
+	// DryRun is set for the --dry-run and --prune-dry-run runs, which didn't deploy anything
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// elapsed is the duration of the whole deploy and finished the time it ended, for the --metrics-file
+	elapsed  time.Duration
+	finished time.Time
+}
+
+// setEnv records the names of the KEY=VALUE entries
+func (s *deploySummary) setEnv(env []string) {
+	s.Env = make([]string, 0, len(env))
+	for _, entry := range env {
+		key, _, _ := strings.Cut(entry, "=")
+		s.Env = append(s.Env, key)
+	}
+}
+
+func (s *deploySummary) setDuration(d time.Duration) {
+	s.DurationSeconds = d.Seconds()
+}
+
+// save replaces the summary file atomically
+func (s runSummary) save(path string) error {
+	if s.Deploys == nil {
+		s.Deploys = []deploySummary{}
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
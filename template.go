@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// templateData is available to the compose files rendered by --template
+type templateData struct {
+	Stack string
+	// Env holds the environment of docker-deploy with the --env-file, --label and --image variables on top
+	Env    map[string]string
+	Config *appConfig
+}
+
+// renderComposeFiles renders the compose files as Go templates into hidden temporary files next to them, so the
+// relative paths inside keep working for both docker-deploy and docker, and returns their names. The returned
+// function removes the rendered files, it has to be called even on error.
+func renderComposeFiles(files []string, data templateData) ([]string, func(), error) {
+	var rendered []string
+
+	cleanup := func() {
+		for _, file := range rendered {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				logger.Warnf("Cannot remove the rendered compose file %s: %s", file, err.Error())
+			}
+		}
+	}
+
+	for _, file := range files {
+		out, err := renderComposeFile(file, data)
+		if out != "" {
+			rendered = append(rendered, out)
+		}
+		if err != nil {
+			return nil, cleanup, err
+		}
+
+		logger.With(logFields{"file": file}).Debugf("Rendered compose file %s to %s", file, out)
+	}
+
+	return rendered, cleanup, nil
+}
+
+func renderComposeFile(file string, data templateData) (string, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	// the template is named after the file so the errors point to its lines, unknown variables are an error
+	tmpl, err := template.New(file).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse the compose template: %w", err)
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".*.rendered")
+	if err != nil {
+		return "", err
+	}
+
+	err = tmpl.Execute(out, data)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return out.Name(), fmt.Errorf("cannot render the compose template: %w", err)
+	}
+
+	return out.Name(), nil
+}
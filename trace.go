@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// traceLogger writes the --trace diagnostic lines: the files opened, the yaml parsed and the commands run with their
+// environment. It writes nothing until an output is set.
+type traceLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+	// mask matches the names of the variables whose values are hidden, nothing is hidden when nil
+	mask *regexp.Regexp
+}
+
+var trace = &traceLogger{}
+
+// enable writes the trace lines to out from now on
+func (t *traceLogger) enable(out io.Writer, mask *regexp.Regexp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.out = out
+	t.mask = mask
+}
+
+func (t *traceLogger) enabled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.out != nil
+}
+
+func (t *traceLogger) Printf(format string, v ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.out == nil {
+		return
+	}
+
+	_, _ = fmt.Fprintf(t.out, "trace %s %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, v...))
+}
+
+// Env writes the KEY=VALUE entries one per line after the title, with the masked values hidden
+func (t *traceLogger) Env(title string, env []string) {
+	if !t.enabled() {
+		return
+	}
+
+	t.Printf("%s (%d variables)", title, len(env))
+	for _, entry := range maskEnv(env, t.mask) {
+		t.Printf("  %s", entry)
+	}
+}